@@ -3,6 +3,7 @@ package encoding
 import (
 	"crypto/sha1"
 	"encoding/base64"
+	"errors"
 )
 
 // Size is the length in bytes of a key.
@@ -34,6 +35,9 @@ func DecodeKeyStr(key string) ([sha1.Size]byte, error) {
 	if err != nil {
 		return hash, err
 	}
+	if len(dec) != sha1.Size {
+		return hash, errors.New("invalid key length")
+	}
 	for i := 0; i < sha1.Size; i++ {
 		hash[i] = dec[i]
 	}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"syscall"
 
 	"github.com/pkg/errors"
 
@@ -18,38 +23,60 @@ import (
 
 var wg sync.WaitGroup
 
+// The key of the bootstrap node is not known in advance.
+// It is learnt from the response when the node is pinged.
 var bootstrapContact = node.Contact{
-	Key:  node.Key{},
 	Host: getLocalIP(),
 	Port: "4000",
 }
 
+// puzzle is the difficulty of the crypto puzzles that node keys must solve.
+var puzzle = node.Puzzle{StaticBits: 8, DynamicBits: 8}
+
 func main() {
-	if len(os.Args) != 2 {
+	storeKind := flag.String("store", "mem", "where values are stored: mem or disk")
+	secure := flag.Bool("secure", false, "only accept contacts with secure keys and signed messages")
+	flag.Usage = printUsageAndExit
+	flag.Parse()
+	if flag.NArg() != 1 {
 		printUsageAndExit()
 	}
 
-	port := os.Args[1]
+	port := flag.Arg(0)
 	if !validPort(port) {
 		printUsageAndExit()
 	}
 
-	p, err := peer.NewPeer(&peer.Options{
-		Key:       node.GenerateRandomKey(),
-		Host:      getLocalIP(),
-		Port:      port,
-		Store:     store.NewMemStore(),
-		NetworkID: "v1",
-	})
+	dataDir := filepath.Join("data", port)
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		log.Fatal(errors.Wrap(err, "failed to create data directory"))
+	}
+	tableFile := filepath.Join(dataDir, "table.json")
+
+	s, err := openStore(*storeKind, filepath.Join(dataDir, "store"))
 	if err != nil {
-		fmt.Println(err)
-		return
+		log.Fatal(errors.Wrap(err, "failed to open store"))
 	}
 
-	// TODO Temporary workaround hack for bootstrap node.
-	// 4000 is the bootstrap node port when running locally!
-	if port == "4000" {
-		p.Contact.Key = node.Key{}
+	identity, err := loadIdentity(filepath.Join(dataDir, "identity.json"), *secure)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "failed to load identity"))
+	}
+
+	p, err := peer.NewPeer(&peer.Options{
+		Key:        identity.Key,
+		PrivateKey: identity.PrivateKey,
+		Proof:      identity.Proof,
+		Host:       getLocalIP(),
+		Port:       port,
+		Store:      s,
+		NetworkID:  "v1",
+		TableFile:  tableFile,
+		SecureIDs:  *secure,
+		Puzzle:     puzzle,
+	})
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "failed to create peer"))
 	}
 
 	ui := NewCommandLineUI()
@@ -61,17 +88,57 @@ func main() {
 
 	wg.Add(3)
 	go server.Run(&wg)
+
+	// Rejoin the network through the contacts known before the last
+	// shutdown. If none of them answer, the bootstrap node must be used.
+	if n, err := p.RestoreTable(tableFile); err != nil {
+		log.Println(errors.Wrap(err, "failed to restore routing table"))
+	} else if n > 0 {
+		log.Printf("Restored %d contacts from %s.", n, tableFile)
+	} else {
+		log.Println("No saved contacts could be reached. Use `bootstrap` to join.")
+	}
+
+	p.Start()
+	go stopOnSignal(p)
+
 	go ui.Run(&wg)
 	go handleInput(ui, p)
 	wg.Wait()
 }
 
+// loadIdentity reads the identity of the node from `path`, or creates a new
+// secure one. In secure mode, an identity without a key pair, as saved by
+// older versions, is replaced by a secure one, which gives the node a new key.
+func loadIdentity(path string, secure bool) (*node.Identity, error) {
+	identity, err := node.LoadOrCreateIdentity(path, puzzle)
+	if err != nil || !secure || identity.PrivateKey != nil {
+		return identity, err
+	}
+	log.Printf("Identity in %s has no key pair. Replacing key [ %s ] with a secure one.", path, identity.Key)
+	if identity, err = node.NewSecureIdentity(puzzle); err != nil {
+		return nil, err
+	}
+	return identity, identity.Save(path)
+}
+
+// openStore opens the store of kind `kind`. A disk store keeps its data in `dir`.
+func openStore(kind, dir string) (store.Store, error) {
+	switch kind {
+	case "mem":
+		return store.NewMemStore(), nil
+	case "disk":
+		return store.NewDiskStore(dir)
+	}
+	return nil, errors.Errorf("unknown store %s", kind)
+}
+
 // handleInput reads a message from a user interface
 // and dispatches a command depending on the message.
-func handleInput(ui UI, peer *peer.Peer) {
+func handleInput(ui UI, p *peer.Peer) {
 	defer wg.Done()
 
-	fmt.Println(uiUsage)
+	fmt.Print(uiUsage)
 
 	for {
 		message := ui.Get()
@@ -82,48 +149,116 @@ func handleInput(ui UI, peer *peer.Peer) {
 		}
 
 		switch action {
-
 		case ActionStore:
-			data := []byte(rest)
-			key := encoding.HashData(data)
-			keyStr := encoding.EncodeHash(key)
-			peer.IterativeStore(key, data)
-			if _, err := peer.Get(keyStr); err != nil {
-				if _, err := peer.Put(data); err != nil {
-					panic(err)
-				}
-			}
-			log.Printf("Stored data. Key: [ %s ].", keyStr)
-
+			err = handleStore(p, rest)
 		case ActionGet:
-			// TODO look first in own store
-			keyStr := rest
-			key, err := encoding.DecodeKeyStr(keyStr)
-			if err != nil {
-				log.Printf("Could not decode key [ %s ].\n", keyStr)
-				panic(err)
-			}
-			data, contacts := peer.IterativeFindValue(key)
-			if data != nil {
-				log.Printf("Data for key [ %s ] is:\n%s\n", keyStr, string(data))
-			} else if contacts != nil {
-				log.Printf("Data for key [ %s ] could not be found.\n", key)
-			} else {
-				panic(errors.New("this should not happen"))
-			}
-
+			err = handleGet(p, rest)
+		case ActionTrace:
+			err = handleTrace(p, rest)
 		case ActionBootstrap:
-			peer.Bootstrap(bootstrapContact)
-
+			err = p.Bootstrap(bootstrapContact)
 		case ActionTable:
-			peer.PrintAllContacts()
-
+			err = handleTable(p, rest)
 		default:
-			fmt.Println(uiUsage)
+			fmt.Print(uiUsage)
+		}
+		if err != nil {
+			log.Println(errors.Wrapf(err, "%s failed", action))
 		}
 	}
 }
 
+// handleStore stores `rest` in the network and in the local store.
+func handleStore(p *peer.Peer, rest string) error {
+	data := []byte(rest)
+	key := encoding.HashData(data)
+	keyStr := encoding.EncodeHash(key)
+	result, err := p.IterativeStoreContext(context.Background(), key, data, 1)
+	if _, err := p.Get(keyStr); err != nil {
+		if _, err := p.Put(data); err != nil {
+			return errors.Wrap(err, "could not store data locally")
+		}
+	}
+	for _, failure := range result.Failed {
+		log.Printf("Could not store data at %s: %s.", failure.Contact, failure.Err)
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not store data in the network")
+	}
+	log.Printf("Stored data at %d nodes. Key: [ %s ].", len(result.Stored), keyStr)
+	return nil
+}
+
+// handleGet looks up the value at the key given in `rest`.
+func handleGet(p *peer.Peer, rest string) error {
+	// TODO look first in own store
+	keyStr := rest
+	key, err := encoding.DecodeKeyStr(keyStr)
+	if err != nil {
+		return errors.Wrapf(err, "could not decode key [ %s ]", keyStr)
+	}
+	data, _, err := p.IterativeFindValueContext(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return errors.Errorf("data for key [ %s ] could not be found", keyStr)
+	}
+	log.Printf("Data for key [ %s ] is:\n%s\n", keyStr, string(data))
+	return nil
+}
+
+// handleTrace looks up the value at the key given in `rest`,
+// and prints a trace of the lookup.
+func handleTrace(p *peer.Peer, rest string) error {
+	trace := &peer.LookupTrace{}
+	ctx := peer.WithLookupTrace(context.Background(), trace)
+	keyStr := rest
+	key, err := encoding.DecodeKeyStr(keyStr)
+	if err != nil {
+		return errors.Wrapf(err, "could not decode key [ %s ]", keyStr)
+	}
+	data, _, err := p.IterativeFindValueContext(ctx, key)
+	fmt.Print(trace)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return errors.Errorf("data for key [ %s ] could not be found", keyStr)
+	}
+	log.Printf("Data for key [ %s ] is:\n%s\n", keyStr, string(data))
+	return nil
+}
+
+// handleTable prints the routing table in the format given in `rest`.
+func handleTable(p *peer.Peer, rest string) error {
+	switch rest {
+	case "":
+		p.PrintAllContacts()
+	case "json":
+		data, err := p.TableSnapshot().JSON()
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	case "dot":
+		return p.TableSnapshot().WriteDOT(os.Stdout)
+	default:
+		return errors.Errorf("unknown table format %s", rest)
+	}
+	return nil
+}
+
+// stopOnSignal stops `p` and exits when the process is interrupted,
+// so that the routing table is saved before shutting down.
+func stopOnSignal(p *peer.Peer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	p.Stop()
+	os.Exit(0)
+}
+
 func validPort(data string) bool {
 	if port, err := strconv.Atoi(data); err != nil || port < 4000 || port > 5000 {
 		return false
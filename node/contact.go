@@ -1,18 +1,25 @@
 package node
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"net"
 	"sort"
+	"time"
 )
 
 // Contact is primarily used to group node key, host and port,
 // but also contains some extra optional useful data.
 type Contact struct {
-	Key  Key
-	Host net.IP
-	Port string
-	RTT  int
+	Key      Key
+	Host     net.IP
+	Port     string
+	RTT      time.Duration // Smoothed round-trip time, zero if unknown.
+	LastSeen time.Time
+	Failures int // Failed RPCs in a row since the contact was last seen.
+
+	PublicKey ed25519.PublicKey // Public key that Key is derived from, if any.
+	Proof     Key               // Solution of the dynamic puzzle, if any.
 }
 
 func (contact Contact) String() string {
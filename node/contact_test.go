@@ -65,3 +65,10 @@ func assertEqual(t *testing.T, value, expected interface{}) {
 		t.Errorf("Expected %v, got %v.\n", expected, value)
 	}
 }
+
+func assertNotEqual(t *testing.T, value, expected interface{}) {
+	if value == expected {
+		t.Errorf("Expected something else than %v, but got %v.\n",
+			expected, value)
+	}
+}
@@ -0,0 +1,101 @@
+package node
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/askft/kademlia/encoding"
+)
+
+// Identity is what a node needs to keep to be recognized
+// as the same node across restarts. A secure identity also
+// has a key pair that its key is derived from.
+type Identity struct {
+	Key        Key
+	PrivateKey ed25519.PrivateKey // Nil unless the identity is secure.
+	Proof      Key                // Solution of the dynamic puzzle.
+}
+
+// savedIdentity is the on-disk representation of an identity.
+type savedIdentity struct {
+	Key   string `json:"key"`
+	Seed  []byte `json:"seed,omitempty"` // Seed of the private key.
+	Proof string `json:"proof,omitempty"`
+}
+
+// NewIdentity creates an identity with a random key.
+func NewIdentity() *Identity {
+	return &Identity{Key: GenerateRandomKey()}
+}
+
+// PublicKey returns the public key of `id`, or nil if it is not secure.
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	if id.PrivateKey == nil {
+		return nil
+	}
+	return id.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+// LoadOrCreateIdentity reads the identity stored at `path`. If there is no
+// such file, a new secure identity that solves `puzzle` is created and
+// saved there.
+func LoadOrCreateIdentity(path string, puzzle Puzzle) (*Identity, error) {
+	id, err := LoadIdentity(path)
+	if os.IsNotExist(errors.Cause(err)) {
+		if id, err = NewSecureIdentity(puzzle); err != nil {
+			return nil, err
+		}
+		return id, id.Save(path)
+	}
+	return id, err
+}
+
+// LoadIdentity reads the identity stored at `path`.
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	saved := savedIdentity{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, errors.Wrapf(err, "could not parse %s", path)
+	}
+	id := &Identity{}
+	if id.Key, err = encoding.DecodeKeyStr(saved.Key); err != nil {
+		return nil, errors.Wrapf(err, "invalid key in %s", path)
+	}
+	if saved.Seed == nil {
+		return id, nil
+	}
+	if len(saved.Seed) != ed25519.SeedSize {
+		return nil, errors.Errorf("invalid private key seed in %s", path)
+	}
+	id.PrivateKey = ed25519.NewKeyFromSeed(saved.Seed)
+	if DeriveKey(id.PublicKey()) != id.Key {
+		return nil, errors.Errorf("key in %s is not derived from the private key", path)
+	}
+	if saved.Proof != "" {
+		if id.Proof, err = encoding.DecodeKeyStr(saved.Proof); err != nil {
+			return nil, errors.Wrapf(err, "invalid proof in %s", path)
+		}
+	}
+	return id, nil
+}
+
+// Save writes `id` to the file at `path`, readable only by the owner.
+func (id *Identity) Save(path string) error {
+	saved := savedIdentity{Key: id.Key.String()}
+	if id.PrivateKey != nil {
+		saved.Seed = id.PrivateKey.Seed()
+		saved.Proof = id.Proof.String()
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,65 @@
+package node
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateRandomKey(t *testing.T) {
+	a := GenerateRandomKey()
+	b := GenerateRandomKey()
+	if a.Equal(b) {
+		t.Errorf("Expected two different keys, got %s twice.", a)
+	}
+}
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "identity.json")
+
+	puzzle := Puzzle{StaticBits: 2, DynamicBits: 2}
+	created, err := LoadOrCreateIdentity(path, puzzle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrCreateIdentity(path, puzzle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, loaded.Key, created.Key)
+	assertEqual(t, loaded.Proof, created.Proof)
+	assertEqual(t, bytes.Equal(loaded.PublicKey(), created.PublicKey()), true)
+}
+
+func TestSecureIdentity(t *testing.T) {
+	puzzle := Puzzle{StaticBits: 4, DynamicBits: 6}
+	id, err := NewSecureIdentity(puzzle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contact := Contact{Key: id.Key, PublicKey: id.PublicKey(), Proof: id.Proof}
+	assertEqual(t, puzzle.Verify(contact), nil)
+
+	// A chosen key is not derived from the public key.
+	chosen := contact
+	chosen.Key[19] ^= 1
+	assertNotEqual(t, puzzle.Verify(chosen), nil)
+
+	// Nor is any key without a public key.
+	assertNotEqual(t, Puzzle{}.Verify(Contact{Key: id.Key}), nil)
+
+	// The proof is bound to the key.
+	wrong := contact
+	wrong.Proof[0] ^= 0xff
+	for puzzle.solvesDynamic(wrong.Key, wrong.Proof) {
+		wrong.Proof[1]++
+	}
+	assertNotEqual(t, puzzle.Verify(wrong), nil)
+}
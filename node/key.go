@@ -1,8 +1,7 @@
 package node
 
 import (
-	"math/rand"
-	"time"
+	"crypto/rand"
 
 	"github.com/askft/kademlia/encoding"
 )
@@ -19,13 +18,12 @@ const (
 	KeySizeBits = KeySizeBytes * 8
 )
 
-// GenerateRandomKey creates a randomized node key.
-// Uses time.Now().Unix() for the random seed.
+// GenerateRandomKey creates a randomized node key using a cryptographically
+// secure random number generator. It panics if the generator fails.
 func GenerateRandomKey() Key {
-	rand.Seed(time.Now().Unix()) // TODO Dangerous?
 	key := Key{}
-	for i := 0; i < KeySizeBytes; i++ {
-		key[i] = uint8(rand.Intn(256))
+	if _, err := rand.Read(key[:]); err != nil {
+		panic(err)
 	}
 	return key
 }
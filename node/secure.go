@@ -0,0 +1,91 @@
+package node
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+
+	"github.com/pkg/errors"
+
+	"github.com/askft/kademlia/encoding"
+)
+
+/*
+	Secure node keys as in S/Kademlia. A node's key is the hash of its
+	public key, so that a node can't choose where in the key space it is.
+	The crypto puzzles make it expensive to generate many keys, and to
+	generate one close to a given key in particular:
+		- static:  H(H(public key)) starts with `StaticBits` zero bits.
+		- dynamic: H(key ⊕ X) starts with `DynamicBits` zero bits, where
+		           X is the proof that the node publishes with its key.
+
+	See https://doi.org/10.1109/ICPADS.2007.4447808
+*/
+
+// Puzzle is the difficulty of the crypto puzzles that secure keys must
+// solve. The zero value does not require any puzzles to be solved.
+type Puzzle struct {
+	StaticBits  int
+	DynamicBits int
+}
+
+// DeriveKey returns the key of the node with public key `pub`.
+func DeriveKey(pub ed25519.PublicKey) Key {
+	return encoding.HashData(pub)
+}
+
+// Verify returns an error unless `contact`'s key is derived from its
+// public key, and solves `puzzle`. It does not show that whoever presents
+// `contact` holds the private key; that takes a signature.
+func (puzzle Puzzle) Verify(contact Contact) error {
+	if len(contact.PublicKey) != ed25519.PublicKeySize {
+		return errors.Errorf("contact %s has no valid public key", contact)
+	}
+	if DeriveKey(contact.PublicKey) != contact.Key {
+		return errors.Errorf("key of contact %s is not derived from its public key", contact)
+	}
+	if !puzzle.solvesStatic(contact.Key) {
+		return errors.Errorf("key of contact %s does not solve the static puzzle", contact)
+	}
+	if !puzzle.solvesDynamic(contact.Key, contact.Proof) {
+		return errors.Errorf("proof of contact %s does not solve the dynamic puzzle", contact)
+	}
+	return nil
+}
+
+// NewSecureIdentity generates key pairs until one has a key that solves the
+// static puzzle, and then searches for a proof that solves the dynamic one.
+// This takes about 2^StaticBits + 2^DynamicBits attempts.
+func NewSecureIdentity(puzzle Puzzle) (*Identity, error) {
+	for {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not generate key pair")
+		}
+		key := DeriveKey(pub)
+		if !puzzle.solvesStatic(key) {
+			continue
+		}
+		proof := GenerateRandomKey()
+		for !puzzle.solvesDynamic(key, proof) {
+			proof = GenerateRandomKey()
+		}
+		return &Identity{Key: key, PrivateKey: priv, Proof: proof}, nil
+	}
+}
+
+func (puzzle Puzzle) solvesStatic(key Key) bool {
+	return zeroBits(encoding.HashData(key[:])) >= puzzle.StaticBits
+}
+
+func (puzzle Puzzle) solvesDynamic(key, proof Key) bool {
+	d := key.Distance(proof)
+	return zeroBits(encoding.HashData(d[:])) >= puzzle.DynamicBits
+}
+
+// zeroBits returns the number of leading zero bits of `key`.
+func zeroBits(key Key) int {
+	if key == (Key{}) {
+		return KeySizeBits
+	}
+	return key.PrefixLength()
+}
@@ -0,0 +1,102 @@
+package peer
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/askft/kademlia/encoding"
+	"github.com/askft/kademlia/node"
+	"github.com/askft/kademlia/store"
+)
+
+/*
+	Caching along the lookup path.
+
+	When an IterativeFindValue succeeds, the initiator stores the value at
+	the closest node it saw that did not return it. Such cached copies
+	expire sooner the further away they are from the key, so that popular
+	values spread toward the nodes that request them without over-caching.
+*/
+
+// putCached stores a cached copy of `data`, published by `publisher`,
+// that expires after `ttl`, unless the peer already holds a regular copy.
+func (peer *Peer) putCached(data []byte, publisher node.Key, ttl time.Duration) (string, error) {
+	key := encoding.EncodeData(data)
+	now := time.Now()
+
+	peer.storing.Lock()
+	defer peer.storing.Unlock()
+
+	if record, err := peer.store.GetRecord(key); err == nil && !record.Cached && !record.Expired(now) {
+		return key, nil // Already a regular copy, which must not expire early.
+	}
+	return peer.store.PutRecord(store.Record{
+		Data:      data,
+		Publisher: publisher,
+		Received:  now,
+		Expires:   now.Add(ttl),
+		Cached:    true,
+	})
+}
+
+// putRegular stores a regular copy of `data`, published by `publisher`,
+// that expires at `expires`, or never if it is zero. It replaces a cached
+// copy, but does not shorten the life of an existing regular copy. It fails
+// if the hash of `data` is a key that holds a mutable value or signed item,
+// which may only be replaced through the checks of putMutable and putItem.
+func (peer *Peer) putRegular(data []byte, publisher node.Key, expires time.Time) (string, error) {
+	key := encoding.EncodeData(data)
+	now := time.Now()
+
+	peer.storing.Lock()
+	defer peer.storing.Unlock()
+
+	if record, err := peer.store.GetRecord(key); err == nil && !record.Cached && !record.Expired(now) {
+		if record.Key != "" {
+			return key, errors.New("key holds a mutable value")
+		}
+		if record.Expires.IsZero() || !expires.IsZero() && record.Expires.After(expires) {
+			expires = record.Expires
+		}
+	}
+	return peer.store.PutRecord(store.Record{
+		Data:      data,
+		Publisher: publisher,
+		Received:  now,
+		Expires:   expires,
+	})
+}
+
+// cacheTTL returns how long a copy cached at a node should live, given
+// that `closer` nodes are known to be closer to the key than that node.
+// The expiry is exponentially inversely proportional to `closer`.
+func cacheTTL(closer int) time.Duration {
+	ttl := timeOptions.Expire
+	for i := 0; i < closer && ttl > cacheMinimumTTL; i++ {
+		ttl /= 2
+	}
+	if ttl < cacheMinimumTTL {
+		ttl = cacheMinimumTTL
+	}
+	return ttl
+}
+
+// sweep deletes the expired records in the peer's store.
+func (peer *Peer) sweep() error {
+	keys, err := peer.store.Keys()
+	if err != nil {
+		return err
+	}
+	peer.storing.Lock()
+	defer peer.storing.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		if record, err := peer.store.GetRecord(key); err == nil && record.Expired(now) {
+			if err := peer.store.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
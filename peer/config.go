@@ -1,27 +1,125 @@
 package peer
 
 import (
+	"crypto/ed25519"
 	"net"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"github.com/askft/kademlia/node"
 	"github.com/askft/kademlia/store"
 )
 
 const (
-	α = 3  // Parallelism parameter for RPC calls.
-	k = 20 // Bucket size.
+	defaultAlpha       = 3               // Parallelism parameter for RPC calls.
+	defaultK           = 20              // Bucket size.
+	defaultPingTimeout = time.Second     // Time for the head of a full bucket to answer a ping.
+	defaultRPCTimeout  = 5 * time.Second // Time before a lookup gives up on an RPC.
+
+	staleThreshold = 5 // Failed RPCs in a row after which a contact is stale.
+	slowFactor     = 2 // How much slower than a newcomer a member of a full bucket may be.
 
-	updateTimeout = 1000 // Milliseconds
+	refreshInterval = 60 * time.Second  // Time between checks for stale buckets.
+	saveInterval    = 300 * time.Second // Time between saves of the routing table.
+	sweepInterval   = 60 * time.Second  // Time between deletions of expired records.
+	cacheMinimumTTL = 60 * time.Second  // Time that a cached copy lives at least.
 )
 
 // Options contains general configuration parameters for a peer.
 type Options struct {
-	Key       node.Key
-	Host      net.IP
-	Port      string
-	Store     store.Store
-	NetworkID string
+	Key        node.Key
+	PrivateKey ed25519.PrivateKey // Key pair that Key is derived from, if any. Signs messages.
+	Proof      node.Key           // Solution of the dynamic puzzle, if any.
+	Host       net.IP
+	Port       string
+	Store      store.Store
+	NetworkID  string
+	TableFile  string    // Path to save the routing table to. Empty disables saving.
+	IPLimits   IPLimits  // Limits on contacts sharing an IP address or subnet.
+	Validator  Validator // Checks mutable values. Nil accepts any value and prefers the latest.
+
+	// Protocol parameters. Zero selects the default.
+	K           int           // Bucket size, and the number of nodes a value is stored at.
+	Alpha       int           // Number of RPCs a lookup sends in parallel.
+	PingTimeout time.Duration // Time for the head of a full bucket to answer a ping.
+	RPCTimeout  time.Duration // Time before a lookup gives up on an RPC.
+	DigitBits   int           // Bits resolved per lookup hop, b in the paper. Must divide the key size.
+	Paths       int           // Number of disjoint paths that lookups take, d in S/Kademlia.
+
+	// Secure mode, in which a contact is only accepted if its key is
+	// derived from its public key and solves the puzzles, and its messages
+	// are signed with the matching private key. See node.Puzzle.
+	SecureIDs bool
+	Puzzle    node.Puzzle
+}
+
+// params holds the protocol parameters that a peer runs with.
+type params struct {
+	k           int
+	α           int
+	b           int
+	d           int
+	pingTimeout time.Duration
+	rpcTimeout  time.Duration
+	secure      bool
+	puzzle      node.Puzzle
+}
+
+// params validates the protocol parameters in `options`
+// and fills in the defaults for those that are zero.
+func (options *Options) params() (params, error) {
+	p := params{
+		k:           options.K,
+		α:           options.Alpha,
+		b:           options.DigitBits,
+		d:           options.Paths,
+		pingTimeout: options.PingTimeout,
+		rpcTimeout:  options.RPCTimeout,
+		secure:      options.SecureIDs,
+		puzzle:      options.Puzzle,
+	}
+	switch {
+	case p.k < 0:
+		return p, errors.Errorf("bucket size %d is negative", p.k)
+	case p.α < 0:
+		return p, errors.Errorf("lookup parallelism %d is negative", p.α)
+	case p.b < 0 || p.b > 8 || p.b > 0 && node.KeySizeBits%p.b != 0:
+		return p, errors.Errorf("bits per digit must be at most 8 and divide %d, got %d", node.KeySizeBits, p.b)
+	case p.d < 0:
+		return p, errors.Errorf("number of disjoint paths %d is negative", p.d)
+	case p.pingTimeout < 0:
+		return p, errors.Errorf("ping timeout %s is negative", p.pingTimeout)
+	case p.rpcTimeout < 0:
+		return p, errors.Errorf("RPC timeout %s is negative", p.rpcTimeout)
+	case p.puzzle.StaticBits < 0 || p.puzzle.DynamicBits < 0:
+		return p, errors.Errorf("puzzle difficulty %+v is negative", p.puzzle)
+	}
+	if p.k == 0 {
+		p.k = defaultK
+	}
+	if p.α == 0 {
+		p.α = defaultAlpha
+	}
+	if p.b == 0 {
+		p.b = 1
+	}
+	if p.d == 0 {
+		p.d = 1
+	}
+	if p.pingTimeout == 0 {
+		p.pingTimeout = defaultPingTimeout
+	}
+	if p.rpcTimeout == 0 {
+		p.rpcTimeout = defaultRPCTimeout
+	}
+	if p.α > p.k {
+		return p, errors.Errorf("lookup parallelism %d exceeds bucket size %d", p.α, p.k)
+	}
+	if p.d > p.k {
+		return p, errors.Errorf("number of disjoint paths %d exceeds bucket size %d", p.d, p.k)
+	}
+	return p, nil
 }
 
 // TimeOptions contains time-specific configuration parameters for a peer.
@@ -33,8 +131,8 @@ type TimeOptions struct {
 }
 
 var timeOptions = TimeOptions{
-	Expire:    86410, // Longer than tReplublish as per the xlattice spec
-	Refresh:   3600,
-	Replicate: 3600,
-	Republish: 86400,
+	Expire:    24*time.Hour + 10*time.Second, // Longer than tReplublish as per the xlattice spec
+	Refresh:   time.Hour,
+	Replicate: time.Hour,
+	Republish: 24 * time.Hour,
 }
@@ -0,0 +1,132 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/askft/kademlia/node"
+)
+
+// ErrorKind classifies why an RPC failed.
+type ErrorKind int
+
+const (
+	// Unreachable means that no connection could be made to the contact,
+	// or that the connection was lost.
+	Unreachable ErrorKind = iota + 1
+
+	// Timeout means that the contact did not answer in time.
+	Timeout
+
+	// RemoteError means that the contact answered with an error.
+	RemoteError
+
+	// ProtocolMismatch means that the contact does not speak the same
+	// protocol, or belongs to another network.
+	ProtocolMismatch
+)
+
+func (kind ErrorKind) String() string {
+	switch kind {
+	case Unreachable:
+		return "unreachable"
+	case Timeout:
+		return "timeout"
+	case RemoteError:
+		return "remote error"
+	case ProtocolMismatch:
+		return "protocol mismatch"
+	}
+	return "unknown error"
+}
+
+// errNetworkMismatch is returned by the server to
+// requests from peers in another network.
+var errNetworkMismatch = errors.New("network mismatch")
+
+// RPCError is returned by the RPC client when a call fails.
+type RPCError struct {
+	Kind    ErrorKind
+	Method  string
+	Contact node.Contact
+	Err     error
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s %s: %s: %v", e.Method, e.Contact.Address(), e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *RPCError) Unwrap() error {
+	return e.Err
+}
+
+// Kind returns the kind of RPC failure behind `err`,
+// or zero if `err` is not caused by an *RPCError.
+func Kind(err error) ErrorKind {
+	if e, ok := errors.Cause(err).(*RPCError); ok {
+		return e.Kind
+	}
+	return 0
+}
+
+// IsUnreachable reports whether `err` was caused by an unreachable contact.
+func IsUnreachable(err error) bool {
+	return Kind(err) == Unreachable
+}
+
+// IsTimeout reports whether `err` was caused by a contact that did not
+// answer in time.
+func IsTimeout(err error) bool {
+	return Kind(err) == Timeout
+}
+
+// IsRemoteError reports whether `err` was caused by a contact that
+// answered with an error.
+func IsRemoteError(err error) bool {
+	return Kind(err) == RemoteError
+}
+
+// IsProtocolMismatch reports whether `err` was caused by a contact that
+// does not speak the same protocol or belongs to another network.
+func IsProtocolMismatch(err error) bool {
+	return Kind(err) == ProtocolMismatch
+}
+
+// classify returns the kind of failure behind `err`, which was returned
+// while dialing (`dialing` is true) or calling a contact with `ctx`.
+// It returns zero if the call failed because `ctx` was cancelled.
+func classify(ctx context.Context, err error, dialing bool) ErrorKind {
+	switch ctx.Err() {
+	case context.Canceled:
+		return 0
+	case context.DeadlineExceeded:
+		return Timeout
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return Timeout
+	}
+	if dialing {
+		return Unreachable
+	}
+	if serverErr, ok := err.(rpc.ServerError); ok {
+		if serverErr.Error() == errNetworkMismatch.Error() ||
+			strings.HasPrefix(serverErr.Error(), "rpc: can't find") {
+			return ProtocolMismatch
+		}
+		return RemoteError
+	}
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Unreachable
+	}
+	if _, ok := err.(*net.OpError); ok {
+		return Unreachable
+	}
+	return ProtocolMismatch
+}
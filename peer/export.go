@@ -0,0 +1,174 @@
+package peer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/askft/kademlia/node"
+)
+
+// TableSnapshot is a structured copy of a peer's routing table,
+// meant to be exported for inspection.
+type TableSnapshot struct {
+	Key     string           `json:"key"`
+	Address string           `json:"address"`
+	Buckets []BucketSnapshot `json:"buckets"` // Non-empty buckets only.
+}
+
+// BucketSnapshot is a copy of a single bucket in a TableSnapshot.
+type BucketSnapshot struct {
+	Index        int               `json:"index"`
+	Contacts     []ContactSnapshot `json:"contacts"`
+	Replacements []ContactSnapshot `json:"replacements,omitempty"`
+}
+
+// ContactSnapshot is a copy of a single contact in a BucketSnapshot.
+type ContactSnapshot struct {
+	Key      string        `json:"key"`
+	Address  string        `json:"address"`
+	LastSeen time.Time     `json:"last_seen"`
+	RTT      time.Duration `json:"rtt"`
+	Failures int           `json:"failures"`
+}
+
+// TableSnapshot returns a snapshot of the peer's routing table.
+func (peer *Peer) TableSnapshot() *TableSnapshot {
+	snapshot := &TableSnapshot{
+		Key:     peer.Contact.Key.String(),
+		Address: peer.Contact.Address(),
+		Buckets: []BucketSnapshot{},
+	}
+	for i, bucket := range peer.table.Snapshot() {
+		if len(bucket.Contacts) == 0 && len(bucket.Replacements) == 0 {
+			continue
+		}
+		snapshot.Buckets = append(snapshot.Buckets, BucketSnapshot{
+			Index:        i,
+			Contacts:     snapshotContacts(bucket.Contacts),
+			Replacements: snapshotContacts(bucket.Replacements),
+		})
+	}
+	return snapshot
+}
+
+func snapshotContacts(contacts []node.Contact) []ContactSnapshot {
+	snapshots := []ContactSnapshot{}
+	for _, contact := range contacts {
+		snapshots = append(snapshots, ContactSnapshot{
+			Key:      contact.Key.String(),
+			Address:  contact.Address(),
+			LastSeen: contact.LastSeen,
+			RTT:      contact.RTT,
+			Failures: contact.Failures,
+		})
+	}
+	return snapshots
+}
+
+// JSON encodes `snapshot` as indented JSON.
+func (snapshot *TableSnapshot) JSON() ([]byte, error) {
+	return json.MarshalIndent(snapshot, "", "  ")
+}
+
+// WriteDOT writes `snapshot` as a Graphviz DOT graph to `w`.
+func (snapshot *TableSnapshot) WriteDOT(w io.Writer) error {
+	return MergeSnapshots(snapshot).WriteDOT(w)
+}
+
+// NetworkGraph is the graph of which peers know which,
+// as merged from the routing tables of one or more peers.
+type NetworkGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphNode is a peer in a NetworkGraph.
+type GraphNode struct {
+	Key      string `json:"key"`
+	Address  string `json:"address"`
+	Snapshot bool   `json:"snapshot"` // True if the peer's own table was merged.
+}
+
+// GraphEdge tells that the peer `From` has the peer `To` in bucket `Bucket`.
+type GraphEdge struct {
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	Bucket   int           `json:"bucket"`
+	RTT      time.Duration `json:"rtt"`
+	Failures int           `json:"failures"`
+}
+
+// MergeSnapshots merges the routing tables of several peers into one graph.
+// Nodes are listed once each, in the order they are first encountered.
+// Replacement candidates are left out.
+func MergeSnapshots(snapshots ...*TableSnapshot) *NetworkGraph {
+	graph := &NetworkGraph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	index := map[string]int{}
+	addNode := func(key, address string) int {
+		i, ok := index[key]
+		if !ok {
+			i = len(graph.Nodes)
+			index[key] = i
+			graph.Nodes = append(graph.Nodes, GraphNode{Key: key, Address: address})
+		}
+		return i
+	}
+
+	for _, snapshot := range snapshots {
+		graph.Nodes[addNode(snapshot.Key, snapshot.Address)].Snapshot = true
+		for _, bucket := range snapshot.Buckets {
+			for _, contact := range bucket.Contacts {
+				addNode(contact.Key, contact.Address)
+				graph.Edges = append(graph.Edges, GraphEdge{
+					From:     snapshot.Key,
+					To:       contact.Key,
+					Bucket:   bucket.Index,
+					RTT:      contact.RTT,
+					Failures: contact.Failures,
+				})
+			}
+		}
+	}
+	return graph
+}
+
+// WriteDOT writes `graph` in Graphviz DOT format to `w`. Peers whose tables
+// were not merged are drawn dashed, and so are edges to stale contacts.
+//
+//	Render with e.g. `dot -Tpng -o network.png`.
+func (graph *NetworkGraph) WriteDOT(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "digraph kademlia {")
+	fmt.Fprintln(b, "  node [shape=box, fontname=monospace];")
+	for _, n := range graph.Nodes {
+		style := ""
+		if !n.Snapshot {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(b, "  %q [label=%q%s];\n", n.Key, shortKey(n.Key)+"\n"+n.Address, style)
+	}
+	for _, e := range graph.Edges {
+		label := fmt.Sprintf("%d", e.Bucket)
+		if e.RTT > 0 {
+			label += fmt.Sprintf(" (%s)", e.RTT.Round(time.Microsecond))
+		}
+		style := ""
+		if e.Failures >= staleThreshold {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(b, "  %q -> %q [label=%q%s];\n", e.From, e.To, label, style)
+	}
+	fmt.Fprintln(b, "}")
+	return b.Flush()
+}
+
+// shortKey returns the first few characters of the encoded key `key`.
+func shortKey(key string) string {
+	if len(key) > 8 {
+		return key[:8]
+	}
+	return key
+}
@@ -0,0 +1,52 @@
+package peer
+
+import (
+	"net"
+
+	"github.com/askft/kademlia/node"
+)
+
+// IPLimits restricts how many contacts that share an IP address or subnet
+// the routing table accepts, which makes it harder for a single host to
+// fill a peer's buckets with keys of its own choosing. Subnets are /24 for
+// IPv4 and /64 for IPv6. Zero means no limit. The limits only hold because
+// the host of a contact is the one it was reached at or connected from,
+// never the one it claims.
+type IPLimits struct {
+	BucketIP     int // Contacts with the same IP address in one bucket.
+	BucketSubnet int // Contacts in the same subnet in one bucket.
+	TableIP      int // Contacts with the same IP address in the whole table.
+	TableSubnet  int // Contacts in the same subnet in the whole table.
+}
+
+// subnet returns the /24 (IPv4) or /64 (IPv6) subnet of `ip`.
+func subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// ipCount counts the contacts that share the IP address and the subnet of
+// a given contact.
+type ipCount struct {
+	ip     int
+	subnet int
+}
+
+func countIPs(contact node.Contact, contacts []node.Contact) ipCount {
+	count := ipCount{}
+	for _, c := range contacts {
+		if c.Host.Equal(contact.Host) {
+			count.ip++
+		}
+		if subnet(c.Host) == subnet(contact.Host) {
+			count.subnet++
+		}
+	}
+	return count
+}
+
+func exceeds(n, limit int) bool {
+	return limit > 0 && n >= limit
+}
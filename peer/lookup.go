@@ -1,10 +1,16 @@
 package peer
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/askft/kademlia/encoding"
 	"github.com/askft/kademlia/node"
+	"github.com/askft/kademlia/store"
 )
 
 /*
@@ -13,147 +19,334 @@ import (
 		- IterativeFindNode
 		- IterativeFindValue
 
+	Each of them has a variant that takes a context. When the context is
+	done, the lookup cancels its outstanding RPCs and returns what it has
+	found so far together with an error that says why it stopped.
+
 	TODO
-		- xlattice: When an IterativeFindValue succeeds, the initiator
-		  must store the key/value pair at the closest node seen which
-		  did not return the value.
 		- Check return values from RPC calls for empty message responses.
 */
 
+// StoreResult lists the outcome of an iterative store
+// at each of the closest nodes to the key.
+type StoreResult struct {
+	Stored []node.Contact // Contacts that acknowledged the STORE.
+	Failed []StoreFailure // Contacts that did not.
+}
+
+// StoreFailure is a contact that did not acknowledge a STORE, and why.
+type StoreFailure struct {
+	Contact node.Contact
+	Err     error
+}
+
+// QuorumError is returned by an iterative store
+// that fewer contacts acknowledged than required.
+type QuorumError struct {
+	Want int
+	Got  int
+}
+
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("store quorum not met: %d of %d required acknowledgements", e.Got, e.Want)
+}
+
 // IterativeStore finds the <=k closest nodes to `target`
 // and sends `data` in a STORE RPC to each.
-func (peer *Peer) IterativeStore(target node.Key, data []byte) {
-	done := make(chan MessageResponseStore)
-	contacts := peer.IterativeFindNode(target)
+func (peer *Peer) IterativeStore(target node.Key, data []byte) (*StoreResult, error) {
+	return peer.IterativeStoreContext(context.Background(), target, data, 0)
+}
+
+// IterativeStoreContext is like IterativeStore, but gives up when `ctx` is
+// done. It waits for all STORE RPCs to complete, and returns a *QuorumError
+// if fewer than `quorum` contacts acknowledged the STORE.
+func (peer *Peer) IterativeStoreContext(ctx context.Context, target node.Key, data []byte, quorum int) (*StoreResult, error) {
+	return peer.iterativeStore(ctx, target, store.Record{Data: data}, quorum, 0)
+}
+
+// iterativeStore is like IterativeStoreContext, but sends `record` with its
+// publisher and expiry, so that they are kept when it is replicated. Zero
+// values stand for this peer and a full expiry time. A signed item is sent
+// with `cas`, see IterativeStoreItem.
+func (peer *Peer) iterativeStore(ctx context.Context, target node.Key, record store.Record, quorum int, cas int64) (*StoreResult, error) {
+	result := &StoreResult{}
+	contacts, err := peer.IterativeFindNodeContext(ctx, target)
+	if err != nil {
+		return result, err
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
 	for _, contact := range contacts {
-		go peer.SendStore(contact, data, done)
+		wg.Add(1)
+		go func(contact node.Contact) {
+			defer wg.Done()
+			req := &MessageRequestStore{
+				Data:      record.Data,
+				Publisher: record.Publisher,
+				Expires:   record.Expires,
+				Signed:    record.Signed,
+				CAS:       cas,
+			}
+			if record.Key != "" {
+				req.Key = target
+			}
+			_, err := peer.sendStore(ctx, contact, req)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				result.Failed = append(result.Failed, StoreFailure{contact, err})
+			} else {
+				result.Stored = append(result.Stored, contact)
+			}
+		}(contact)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return result, errors.Wrap(err, "store stopped")
+	}
+	if len(result.Stored) < quorum {
+		return result, &QuorumError{Want: quorum, Got: len(result.Stored)}
 	}
-	// res := <-done
-	// TODO print something about success?
+	return result, nil
 }
 
 // IterativeFindNode finds the <=k closest nodes to `target`.
 func (peer *Peer) IterativeFindNode(target node.Key) []node.Contact {
-	var (
-		results = []node.Contact{}
-		todo    = []node.Contact{}
-		seen    = make(map[string]bool)
-		done    = make(chan MessageResponseFindNode)
-	)
-	for _, contact := range peer.FindClosest(target, α) {
-		results = append(results, contact)
-		todo = append(todo, contact)
-		seen[contact.Key.String()] = true
+	contacts, _ := peer.IterativeFindNodeContext(context.Background(), target)
+	return contacts
+}
+
+// IterativeFindNodeContext is like IterativeFindNode, but gives up when
+// `ctx` is done. It then returns the closest nodes found so far.
+func (peer *Peer) IterativeFindNodeContext(ctx context.Context, target node.Key) ([]node.Contact, error) {
+	query := func(ctx context.Context, contact node.Contact) ([]node.Contact, []byte, error) {
+		res, err := peer.SendFindNode(ctx, contact, target) // the reciever node does FindClosest
+		if err != nil {
+			return nil, nil, err
+		}
+		return res.Contacts, nil, nil
 	}
+	_, list, err := peer.lookup(ctx, target, query)
+	return list.results(), errors.Wrap(err, "find node lookup stopped")
+}
 
-	// Number of pending nodes
-	pending := 0
+// IterativeFindValue attemps to find the value at `target`. If the value
+// can't be found, the <=k closest nodes to `target` are returned.
+func (peer *Peer) IterativeFindValue(target node.Key) ([]byte, []node.Contact) {
+	data, contacts, _ := peer.IterativeFindValueContext(context.Background(), target)
+	return data, contacts
+}
 
-	// Send async FIND_NODE RPCs to α nodes
-	for i := 0; i < α && len(todo) > 0; i++ {
-		contact := todo[0]
-		todo = todo[1:]
-		go peer.SendFindNode(contact, target, done) // the reciever node does FindClosest
-		pending++
+// IterativeFindValueContext is like IterativeFindValue, but gives up when
+// `ctx` is done. It then returns the closest nodes found so far.
+func (peer *Peer) IterativeFindValueContext(ctx context.Context, target node.Key) ([]byte, []node.Contact, error) {
+	data, list, err := peer.findValue(ctx, target, func(res *MessageResponseFindValue) error {
+		if encoding.EncodeHash(target) != encoding.EncodeData(res.Data) {
+			return errors.New("value does not match key")
+		}
+		return nil
+	})
+	if data != nil {
+		peer.cacheAlongPath(list, data)
+		return data, nil, nil
 	}
+	return nil, list.results(), errors.Wrap(err, "find value lookup stopped")
+}
 
-	// While there are still nodes to query
-	for pending > 0 {
-		res := <-done // Get the RPC result from a node
-		pending--
+// findValue looks up the value at `target`. Responses with a value for
+// which `check` returns an error are treated as failed RPCs.
+func (peer *Peer) findValue(ctx context.Context, target node.Key, check func(*MessageResponseFindValue) error) ([]byte, *shortlist, error) {
+	query := func(ctx context.Context, contact node.Contact) ([]node.Contact, []byte, error) {
+		res, err := peer.SendFindValue(ctx, contact, target) // the reciever node does FindClosest
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(res.Data) > 0 {
+			if err := check(res); err != nil {
+				return nil, nil, err
+			}
+			return nil, res.Data, nil
+		}
+		return res.Contacts, nil, nil
+	}
+	return peer.lookup(ctx, target, query)
+}
 
-		for _, contact := range res.Contacts {
+// cacheAlongPath stores `data` at the closest contact in `list` that
+// answered without it, in the background. The cached copy gets a shorter
+// expiry the more contacts are known to be closer to the key.
+func (peer *Peer) cacheAlongPath(list *shortlist, data []byte) {
+	contact, closer, ok := list.cacheTarget()
+	if !ok {
+		return
+	}
+	go peer.SendStore(context.Background(), contact, data, cacheTTL(closer))
+}
 
-			// self
-			if peer.Contact.Key.Equal(contact.Key) {
-				continue
-			}
+// queryFunc sends the RPC of a lookup to `contact`. It returns the contacts
+// that were given in response, or the value if one was found.
+type queryFunc func(ctx context.Context, contact node.Contact) ([]node.Contact, []byte, error)
 
-			// Node hasn't been queried before
-			if _, ok := seen[contact.Key.String()]; !ok {
-				results = append(results, contact)
-				todo = append(todo, contact)
-				seen[contact.Key.String()] = true
-			}
-		}
+type queryResult struct {
+	entry    *shortlistEntry
+	contacts []node.Contact
+	value    []byte
+	err      error
+	latency  time.Duration
+}
 
-		// Again, send async FIND_NODE RPCs to α nodes
-		for pending < α && len(todo) > 0 {
-			contact := todo[0]
-			todo = todo[1:]
-			go peer.SendFindNode(contact, target, done)
-			pending++
+// lookup performs an iterative lookup of `target`, querying contacts in
+// rounds of α RPCs. If a round does not find any contact closer than the
+// closest one already known, the next round queries all of the k closest
+// contacts that have not been queried yet. The lookup ends when the k
+// closest contacts have all answered, or as soon as a value is found.
+// It returns the value if one was found, and the shortlist of contacts.
+// If `ctx` carries a LookupTrace, every RPC is recorded in it.
+//
+// With d > 1 disjoint paths, the lookup is split as in S/Kademlia: the
+// initial contacts are divided among d paths that run in parallel, and a
+// contact is never queried by more than one path. The shortlists of the
+// paths are merged when they are all done, so that a path which has been
+// steered by malicious contacts does not decide the result on its own.
+//
+//	See https://pdos.csail.mit.edu/~petar/papers/maymounkov-kademlia-lncs.pdf
+//	and https://doi.org/10.1109/ICPADS.2007.4447808
+func (peer *Peer) lookup(ctx context.Context, target node.Key, query queryFunc) (value []byte, list *shortlist, err error) {
+	// Cancels the outstanding RPCs when the lookup returns.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	trace := lookupTraceFrom(ctx)
+	trace.start(target, peer.d)
+	defer func() { trace.finish(err) }()
+
+	peer.RefreshBucket(peer.table.BucketIndex(target))
+	initial := peer.FindClosest(target, peer.k)
+
+	if peer.d == 1 {
+		list = newShortlist(peer.Contact.Key, target, peer.k, peer.b)
+		list.add(initial)
+		value, err = peer.walk(ctx, query, list, 1)
+		return value, list, err
+	}
+
+	claims := &claimSet{claimed: map[node.Key]int{}}
+	lists := make([]*shortlist, peer.d)
+	for i := range lists {
+		lists[i] = newShortlist(peer.Contact.Key, target, peer.k, peer.b)
+		lists[i].claims = claims
+		lists[i].path = i + 1
+	}
+	for i, contact := range initial {
+		lists[i%peer.d].add([]node.Contact{contact})
+	}
+
+	type pathResult struct {
+		value []byte
+		list  *shortlist
+		err   error
+	}
+	done := make(chan pathResult, peer.d)
+	for i, list := range lists {
+		go func(path int, list *shortlist) {
+			value, err := peer.walk(ctx, query, list, path)
+			if value != nil {
+				cancel() // The other paths are not needed anymore.
+			}
+			done <- pathResult{value, list, err}
+		}(i+1, list)
+	}
+	for range lists {
+		r := <-done
+		switch {
+		case r.value != nil && value == nil:
+			value, list = r.value, r.list
+		case r.err != nil && err == nil:
+			err = r.err
 		}
 	}
-	node.SortByDistance(results, target)
-	if len(results) > k {
-		results = results[:k]
+	if value != nil {
+		return value, list, nil
 	}
-	return results
+	return nil, mergeShortlists(lists), err
 }
 
-// IterativeFindValue attemps to find the value at `target`. If the value
-// can't be found, the <=k closest nodes to `target` are returned.
-func (peer *Peer) IterativeFindValue(target node.Key) ([]byte, []node.Contact) {
-	var (
-		results = []node.Contact{}
-		todo    = []node.Contact{}
-		seen    = make(map[string]bool)
-		done    = make(chan MessageResponseFindValue)
-	)
-	for _, contact := range peer.FindClosest(target, α) {
-		results = append(results, contact)
-		todo = append(todo, contact)
-		seen[contact.Key.String()] = true
-	}
-
-	// Number of pending nodes
-	pending := 0
-
-	// Send async FIND_VALUE RPCs to α nodes
-	for i := 0; i < α && len(todo) > 0; i++ {
-		contact := todo[0]
-		todo = todo[1:]
-		go peer.SendFindValue(contact, target, done) // the recieves node does FindClosest
-		pending++
-	}
-
-	// While there are still nodes to query
-	for pending > 0 {
-		res := <-done // Get the RPC result from a node
-		pending--
-
-		// If a value was found, return it immediately
-		if res.Data != nil || len(res.Data) > 0 {
-			// TODO this condition will always be true if we get here
-			if encoding.EncodeHash(target) == encoding.EncodeData(res.Data) {
-				fmt.Println("found value, returning")
-				// TODO store in cache, see top of this file
-				return res.Data, nil
-			}
-			fmt.Println("this should not print. value was found, but not the correct one. search continues...")
+// walk runs the rounds of a lookup on `list`,
+// which is path number `path` of the lookup.
+func (peer *Peer) walk(ctx context.Context, query queryFunc, list *shortlist, path int) ([]byte, error) {
+	trace := lookupTraceFrom(ctx)
+	stalled := false
+	for hop := 1; ; hop++ {
+		n := peer.α
+		if stalled {
+			n = peer.k
 		}
+		batch := list.next(n)
+		if len(batch) == 0 {
+			return nil, nil
+		}
+		before, _ := list.best()
+		trace.hop(hop)
 
-		for _, contact := range res.Contacts {
-			// Contact hasn't been queried before
-			if _, ok := seen[contact.Key.String()]; !ok {
-				results = append(results, contact)
-				todo = append(todo, contact)
-				seen[contact.Key.String()] = true
-			}
+		done := make(chan queryResult, len(batch))
+		for _, entry := range batch {
+			entry.state = inFlight
+			go func(entry *shortlistEntry) {
+				start := time.Now()
+				contacts, value, err := query(ctx, entry.contact)
+				done <- queryResult{entry, contacts, value, err, time.Since(start)}
+			}(entry)
 		}
 
-		// Again, send async FIND_VALUE RPCs to α nodes
-		for pending < α && len(todo) > 0 {
-			contact := todo[0]
-			todo = todo[1:]
-			go peer.SendFindValue(contact, target, done)
-			pending++
+		for range batch {
+			var r queryResult
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case r = <-done:
+			}
+			trace.query(QueryTrace{
+				Contact:  r.entry.contact,
+				Path:     path,
+				Hop:      hop,
+				Latency:  r.latency,
+				Contacts: r.contacts,
+				Value:    r.value != nil,
+				Err:      r.err,
+			})
+			if r.err != nil {
+				r.entry.state = failed
+				continue
+			}
+			if r.value != nil {
+				r.entry.state = found
+				return r.value, nil
+			}
+			r.entry.state = succeeded
+			list.add(peer.withLocalRTT(r.contacts))
 		}
+
+		after, ok := list.best()
+		stalled = !ok || !list.target.Distance(after.Key).Less(list.target.Distance(before.Key))
 	}
-	node.SortByDistance(results, target)
-	if len(results) > k {
-		results = results[:k]
+}
+
+// withLocalRTT returns copies of `contacts` that carry the round-trip times
+// measured by this peer, rather than those reported by another peer.
+// In secure mode, contacts whose keys are not verified are left out.
+func (peer *Peer) withLocalRTT(contacts []node.Contact) []node.Contact {
+	local := make([]node.Contact, 0, len(contacts))
+	for _, contact := range contacts {
+		if peer.verifyKey(contact) != nil {
+			continue
+		}
+		contact.RTT = peer.table.RTT(contact.Key)
+		local = append(local, contact)
 	}
-	return nil, results
+	return local
 }
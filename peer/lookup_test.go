@@ -0,0 +1,506 @@
+package peer
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/askft/kademlia/encoding"
+	"github.com/askft/kademlia/node"
+	"github.com/askft/kademlia/store"
+)
+
+func TestLookupContextDeadline(t *testing.T) {
+	p, server := newTestPeer(t)
+	defer server.Close()
+
+	silent, listener := newSilentContact(t)
+	defer listener.Close()
+	p.table.Add(silent)
+	failures := func() int {
+		return p.table.Bucket(p.table.BucketIndex(silent.Key)).Contacts[0].Failures
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	data, _, err := p.IterativeFindValueContext(ctx, encoding.HashData([]byte("value")))
+	if data != nil {
+		t.Errorf("Expected no data, got %v.", data)
+	}
+	assertEqual(t, errors.Cause(err), context.DeadlineExceeded)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Lookup took %s after its deadline.", elapsed)
+	}
+
+	// The contact is not to blame for the deadline of the lookup,
+	// but it is for missing the timeout of the RPC itself.
+	assertEqual(t, failures(), 0)
+	p.pingTimeout = 10 * time.Millisecond
+	_, err = p.SendPing(context.Background(), silent)
+	assertEqual(t, IsTimeout(err), true)
+	assertEqual(t, failures(), 1)
+}
+
+func TestLookupSkipsUnreachableContacts(t *testing.T) {
+	p, server := newTestPeer(t)
+	defer server.Close()
+	alive, server := newTestPeer(t)
+	defer server.Close()
+	dead, server := newTestPeer(t)
+	server.Close()
+
+	p.table.Add(alive.Contact)
+	p.table.Add(dead.Contact)
+
+	contacts, err := p.IterativeFindNodeContext(context.Background(), dead.Contact.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(contacts), 1)
+	assertEqual(t, contacts[0].Key, alive.Contact.Key)
+}
+
+func TestShortlist(t *testing.T) {
+	target := node.Key{}
+	list := newShortlist(testKey(0xff), target, defaultK, 1)
+	contacts := []node.Contact{}
+	for _, b := range []byte{9, 3, 7, 1, 5, 0xff} {
+		contacts = append(contacts, node.Contact{Key: testKey(b)})
+	}
+	list.add(contacts)
+	list.add(contacts[:2])
+	assertEqual(t, len(list.entries), 5)
+
+	next := list.next(2)
+	assertEqual(t, len(next), 2)
+	assertEqual(t, next[0].contact.Key, testKey(1))
+	assertEqual(t, next[1].contact.Key, testKey(3))
+
+	next[0].state = failed
+	next[1].state = succeeded
+	best, _ := list.best()
+	assertEqual(t, best.Key, testKey(3))
+	assertEqual(t, list.next(defaultK)[0].contact.Key, testKey(5))
+	assertEqual(t, len(list.results()), 1)
+}
+
+func TestLookupTrace(t *testing.T) {
+	peers, stop := newTestNetwork(t, 6)
+	defer stop()
+	data := []byte("traced")
+	if _, err := peers[3].Put(data); err != nil {
+		t.Fatal(err)
+	}
+
+	trace := &LookupTrace{}
+	ctx := WithLookupTrace(context.Background(), trace)
+	found, _, err := peers[5].IterativeFindValueContext(ctx, encoding.HashData(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(found), string(data))
+
+	assertEqual(t, trace.Target, node.Key(encoding.HashData(data)))
+	assertNotEqual(t, trace.Hops, 0)
+	assertNotEqual(t, trace.Duration, time.Duration(0))
+	assertEqual(t, trace.Timeouts(), 0)
+	last := trace.Queries[len(trace.Queries)-1]
+	assertEqual(t, last.Value, true)
+	assertEqual(t, last.Contact.Key, peers[3].Contact.Key)
+}
+
+// newTestNetwork starts `n` peers that have all joined through the
+// first one. The returned function stops their servers.
+func newTestNetwork(t *testing.T, n int) ([]*Peer, func()) {
+	peers := []*Peer{}
+	servers := []*Server{}
+	for i := 0; i < n; i++ {
+		p, server := newTestPeer(t)
+		if i > 0 {
+			if err := p.Bootstrap(peers[0].Contact); err != nil {
+				t.Fatal(err)
+			}
+		}
+		peers = append(peers, p)
+		servers = append(servers, server)
+	}
+	return peers, func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}
+}
+
+func TestCachedCopyExpires(t *testing.T) {
+	p, server := newTestPeer(t)
+	defer server.Close()
+	holder, server := newTestPeer(t)
+	defer server.Close()
+
+	cached := []byte("cached")
+	regular := []byte("regular")
+	if _, err := holder.Put(regular); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{cached, regular} {
+		if _, err := p.SendStore(context.Background(), holder.Contact, data, 250*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := holder.Get(encoding.EncodeData(cached))
+	assertEqual(t, err, nil)
+
+	time.Sleep(400 * time.Millisecond)
+	_, err = holder.Get(encoding.EncodeData(cached))
+	assertNotEqual(t, err, nil)
+	_, err = holder.Get(encoding.EncodeData(regular))
+	assertEqual(t, err, nil)
+}
+
+func TestCacheTarget(t *testing.T) {
+	list := newShortlist(testKey(0xff), node.Key{}, defaultK, 1)
+	list.add([]node.Contact{{Key: testKey(1)}, {Key: testKey(2)}, {Key: testKey(3)}, {Key: testKey(4)}})
+	list.entries[0].state = found
+	list.entries[1].state = failed
+	list.entries[2].state = succeeded
+	list.entries[3].state = succeeded
+
+	contact, closer, ok := list.cacheTarget()
+	assertEqual(t, ok, true)
+	assertEqual(t, contact.Key, testKey(3))
+	assertEqual(t, closer, 1)
+
+	assertEqual(t, cacheTTL(0), timeOptions.Expire)
+	assertEqual(t, cacheTTL(1), timeOptions.Expire/2)
+	assertEqual(t, cacheTTL(100), cacheMinimumTTL)
+}
+
+func TestIterativeStoreQuorum(t *testing.T) {
+	peers, stop := newTestNetwork(t, 4)
+	defer stop()
+	data := []byte("quorum")
+
+	result, err := peers[1].IterativeStoreContext(context.Background(), encoding.HashData(data), data, 3)
+	assertEqual(t, err, nil)
+	assertEqual(t, len(result.Stored), 3)
+	assertEqual(t, len(result.Failed), 0)
+
+	result, err = peers[1].IterativeStoreContext(context.Background(), encoding.HashData(data), data, 4)
+	quorumErr, ok := err.(*QuorumError)
+	assertEqual(t, ok, true)
+	assertEqual(t, quorumErr.Got, 3)
+	assertEqual(t, len(result.Stored), 3)
+}
+
+func TestShortlistPrefersLowLatency(t *testing.T) {
+	list := newShortlist(testKey(0xff, 0xff), node.Key{}, defaultK, 1)
+	list.add([]node.Contact{
+		{Key: testKey(1, 1), RTT: 30 * time.Millisecond},
+		{Key: testKey(1, 2)},
+		{Key: testKey(1, 3), RTT: 10 * time.Millisecond},
+		{Key: testKey(0, 1), RTT: 90 * time.Millisecond},
+	})
+
+	next := list.next(3)
+	assertEqual(t, next[0].contact.Key, testKey(0, 1))
+	assertEqual(t, next[1].contact.Key, testKey(1, 3))
+	assertEqual(t, next[2].contact.Key, testKey(1, 1))
+}
+
+// simulateHops builds the routing tables of `n` nodes that know every other
+// node, as far as their buckets allow, and returns the average number of
+// hops a greedy lookup takes to reach the closest node to a key.
+func simulateHops(n, k, b, lookups int) float64 {
+	keys := make([]node.Key, n)
+	tables := map[node.Key]*RoutingTable{}
+	for i := range keys {
+		keys[i] = encoding.HashData([]byte("node" + strconv.Itoa(i)))
+		tables[keys[i]] = NewRoutingTable(keys[i], k, b, IPLimits{})
+	}
+	for _, self := range keys {
+		for _, key := range keys {
+			tables[self].Add(node.Contact{Key: key})
+		}
+	}
+
+	hops := 0
+	for i := 0; i < lookups; i++ {
+		target := node.Key(encoding.HashData([]byte("target" + strconv.Itoa(i))))
+		current := keys[i%n]
+		for {
+			closest := tables[current].Closest(target, 1)
+			if len(closest) == 0 || !target.Distance(closest[0].Key).Less(target.Distance(current)) {
+				break
+			}
+			current = closest[0].Key
+			hops++
+		}
+	}
+	return float64(hops) / float64(lookups)
+}
+
+func TestDigitBucketsReduceHops(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulates a large network")
+	}
+	binary := simulateHops(1000, 4, 1, 500)
+	accelerated := simulateHops(1000, 4, 4, 500)
+	t.Logf("average hops: %.2f with b = 1, %.2f with b = 4", binary, accelerated)
+	if accelerated >= binary {
+		t.Errorf("Expected fewer hops with b = 4, got %.2f and %.2f", accelerated, binary)
+	}
+}
+
+func TestDisjointPaths(t *testing.T) {
+	peers, stop := newTestNetwork(t, 10)
+	defer stop()
+	p := peers[len(peers)-1]
+	target := peers[3].Contact.Key
+
+	single := p.IterativeFindNode(target)
+
+	p.d = 3
+	trace := &LookupTrace{}
+	ctx := WithLookupTrace(context.Background(), trace)
+	disjoint, err := p.IterativeFindNodeContext(ctx, target)
+	assertEqual(t, err, nil)
+	assertEqual(t, trace.Paths, 3)
+	assertEqual(t, len(disjoint), len(single))
+	assertEqual(t, disjoint[0].Key, target)
+
+	paths := map[node.Key]int{}
+	for _, q := range trace.Queries {
+		if path, ok := paths[q.Contact.Key]; ok && path != q.Path {
+			t.Errorf("Expected %s to be queried on one path, got paths %d and %d", q.Contact, path, q.Path)
+		}
+		paths[q.Contact.Key] = q.Path
+	}
+}
+
+func TestShortlistClaims(t *testing.T) {
+	contacts := []node.Contact{}
+	for i := 1; i <= 6; i++ {
+		contacts = append(contacts, node.Contact{Key: testKey(byte(i))})
+	}
+	claims := &claimSet{claimed: map[node.Key]int{}}
+	a := newShortlist(testKey(0xff), node.Key{}, defaultK, 1)
+	a.claims, a.path = claims, 1
+	b := newShortlist(testKey(0xff), node.Key{}, defaultK, 1)
+	b.claims, b.path = claims, 2
+	a.add(contacts)
+	b.add(contacts)
+
+	next := a.next(3)
+	assertEqual(t, len(next), 3)
+	for _, entry := range next {
+		entry.state = succeeded
+	}
+	next = b.next(3)
+	assertEqual(t, len(next), 3)
+	assertEqual(t, next[0].contact.Key, testKey(4))
+	for _, entry := range next {
+		entry.state = failed
+	}
+
+	merged := mergeShortlists([]*shortlist{a, b})
+	assertEqual(t, len(merged.entries), 6)
+	assertEqual(t, len(merged.results()), 3)
+	assertEqual(t, len(merged.next(defaultK)), 0)
+}
+
+func TestReplicateAndRepublish(t *testing.T) {
+	peers, stop := newTestNetwork(t, 4)
+	defer stop()
+	holder, publisher := peers[1], peers[2]
+	has := func(p *Peer, data []byte) (store.Record, bool) {
+		record, err := p.Record(encoding.EncodeData(data))
+		return record, err == nil
+	}
+
+	// A value received long ago is replicated with its publisher and expiry,
+	// while one that was just received is left alone.
+	old := []byte("old")
+	expires := time.Now().Add(time.Hour).Round(time.Second)
+	holder.store.PutRecord(store.Record{
+		Data:      old,
+		Publisher: publisher.Contact.Key,
+		Received:  time.Now().Add(-2 * timeOptions.Replicate),
+		Expires:   expires,
+	})
+	recent := []byte("recent")
+	holder.store.PutRecord(store.Record{
+		Data:      recent,
+		Publisher: publisher.Contact.Key,
+		Received:  time.Now(),
+		Expires:   expires,
+	})
+	assertEqual(t, holder.replicate(context.Background()), nil)
+	for _, p := range peers {
+		if p == holder {
+			continue
+		}
+		record, ok := has(p, old)
+		assertEqual(t, ok, true)
+		assertEqual(t, record.Publisher, publisher.Contact.Key)
+		assertEqual(t, record.Expires.Equal(expires), true)
+		_, ok = has(p, recent)
+		assertEqual(t, ok, false)
+	}
+
+	// The publisher renews the expiry of its own values.
+	value := []byte("published")
+	if _, err := publisher.Put(value); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, publisher.republish(context.Background()), nil)
+	record, ok := has(holder, value)
+	assertEqual(t, ok, true)
+	assertEqual(t, record.Publisher, publisher.Contact.Key)
+	assertEqual(t, record.Expires.After(time.Now().Add(timeOptions.Expire-time.Minute)), true)
+}
+
+// prefixValidator accepts values that start with "v", and prefers the
+// highest one.
+type prefixValidator struct{}
+
+func (prefixValidator) Validate(key node.Key, value []byte) error {
+	if len(value) == 0 || value[0] != 'v' {
+		return errors.New("value must start with v")
+	}
+	return nil
+}
+
+func (prefixValidator) Select(key node.Key, values [][]byte) (int, error) {
+	best := 0
+	for i, value := range values {
+		if string(value) > string(values[best]) {
+			best = i
+		}
+	}
+	return best, nil
+}
+
+func TestMutableKeys(t *testing.T) {
+	peers, stop := newTestNetwork(t, 4)
+	defer stop()
+	key := node.Key(encoding.HashData([]byte("name")))
+
+	// With the default validator, the latest value wins.
+	for _, value := range []string{"first", "second"} {
+		result, err := peers[1].IterativeStoreKey(context.Background(), key, []byte(value), 3)
+		assertEqual(t, err, nil)
+		assertEqual(t, len(result.Stored), 3)
+	}
+	value, _, err := peers[2].IterativeFindKey(context.Background(), key)
+	assertEqual(t, err, nil)
+	assertEqual(t, string(value), "second")
+
+	// A lookup of immutable data does not accept the value.
+	value, _ = peers[2].IterativeFindValue(key)
+	assertEqual(t, value == nil, true)
+
+	// Nor can the value be replaced by storing the data that hashes to its key.
+	_, err = peers[1].SendStore(context.Background(), peers[2].Contact, []byte("name"), 0)
+	assertEqual(t, IsRemoteError(err), true)
+	_, err = peers[2].Put([]byte("name"))
+	assertNotEqual(t, err, nil)
+	record, err := peers[2].Record(encoding.EncodeHash(key))
+	assertEqual(t, err, nil)
+	assertEqual(t, string(record.Data), "second")
+
+	// A validator rejects invalid values and keeps the best one. It is set
+	// on a fresh network, as RPCs of the lookups above may still be running.
+	peers, stop = newTestNetwork(t, 4)
+	defer stop()
+	for _, p := range peers {
+		p.validator = prefixValidator{}
+	}
+	other := node.Key(encoding.HashData([]byte("other")))
+	_, err = peers[1].IterativeStoreKey(context.Background(), other, []byte("invalid"), 1)
+	assertNotEqual(t, err, nil)
+	for _, value := range []string{"v2", "v1"} {
+		_, err := peers[1].IterativeStoreKey(context.Background(), other, []byte(value), 1)
+		assertEqual(t, err, nil)
+	}
+	value, _, err = peers[3].IterativeFindKey(context.Background(), other)
+	assertEqual(t, err, nil)
+	assertEqual(t, string(value), "v2")
+}
+
+func TestSignedItems(t *testing.T) {
+	peers, stop := newTestNetwork(t, 4)
+	defer stop()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assertEqual(t, err, nil)
+	salt := []byte("salt")
+	assertEqual(t, ItemKey(pub, salt) == ItemKey(pub, nil), false)
+
+	for _, seq := range []int64{1, 2} {
+		item := NewSignedItem(priv, salt, seq, []byte("v"+strconv.FormatInt(seq, 10)))
+		result, err := peers[1].IterativeStoreItem(context.Background(), item, 0, 3)
+		assertEqual(t, err, nil)
+		assertEqual(t, len(result.Stored), 3)
+	}
+	item, _, err := peers[2].IterativeFindItem(context.Background(), pub, salt)
+	assertEqual(t, err, nil)
+	assertEqual(t, item.Seq, int64(2))
+	assertEqual(t, string(item.Value), "v2")
+
+	// The item can't be replaced by storing the data that hashes to its key.
+	preimage := append(append([]byte{}, pub...), salt...)
+	_, err = peers[1].SendStore(context.Background(), peers[2].Contact, preimage, 0)
+	assertEqual(t, IsRemoteError(err), true)
+	record, err := peers[2].Record(encoding.EncodeHash(ItemKey(pub, salt)))
+	assertEqual(t, err, nil)
+	assertEqual(t, record.Signed, true)
+
+	// Older items, tampered items and failed compare-and-swaps are rejected.
+	older := NewSignedItem(priv, salt, 1, []byte("v1"))
+	result, _ := peers[1].IterativeStoreItem(context.Background(), older, 0, 1)
+	assertEqual(t, len(result.Stored), 0)
+	tampered := NewSignedItem(priv, salt, 3, []byte("v3"))
+	tampered.Value = []byte("forged")
+	_, err = peers[1].IterativeStoreItem(context.Background(), tampered, 0, 1)
+	assertNotEqual(t, err, nil)
+	next := NewSignedItem(priv, salt, 3, []byte("v3"))
+	result, _ = peers[1].IterativeStoreItem(context.Background(), next, 1, 1)
+	assertEqual(t, len(result.Stored), 0)
+	result, err = peers[1].IterativeStoreItem(context.Background(), next, 2, 3)
+	assertEqual(t, err, nil)
+	assertEqual(t, len(result.Stored), 3)
+
+	// A signed item cannot be overwritten by an unsigned value.
+	assertNotEqual(t, peers[3].PutKey(next.Key(), []byte("plain")), nil)
+
+	// The lookup returns the highest sequence number that any node holds.
+	newest := NewSignedItem(priv, salt, 4, []byte("v4"))
+	data, err := json.Marshal(newest)
+	assertEqual(t, err, nil)
+	assertEqual(t, peers[3].putItem(newest.Key(), data, peers[3].Contact.Key, time.Time{}, 0), nil)
+	item, _, err = peers[2].IterativeFindItem(context.Background(), pub, salt)
+	assertEqual(t, err, nil)
+	assertEqual(t, item.Seq, int64(4))
+
+	// A lookup of the key as a mutable value checks the signature.
+	data, _, err = peers[2].IterativeFindKey(context.Background(), newest.Key())
+	assertEqual(t, err, nil)
+	_, err = decodeItem(newest.Key(), data)
+	assertEqual(t, err, nil)
+	for _, p := range peers {
+		record, err := p.store.GetRecord(encoding.EncodeHash(newest.Key()))
+		if err != nil {
+			continue // The peer that stored the item does not hold it.
+		}
+		record.Data = []byte(`{"v":"Zm9yZ2Vk"}`)
+		_, err = p.store.PutRecord(record)
+		assertEqual(t, err, nil)
+	}
+	data, _, _ = peers[2].IterativeFindKey(context.Background(), newest.Key())
+	assertEqual(t, data == nil, true)
+}
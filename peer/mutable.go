@@ -0,0 +1,115 @@
+package peer
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/askft/kademlia/encoding"
+	"github.com/askft/kademlia/node"
+	"github.com/askft/kademlia/store"
+)
+
+/*
+	Mutable values.
+
+	Besides immutable data, which is stored at the hash of the data, a
+	peer can store a value at a key of its own choosing, such as the hash
+	of a name. Since nothing ties such a value to its key, a Validator
+	decides which values are acceptable, and which of two values for the
+	same key is the better one to keep.
+*/
+
+// Validator checks the values of mutable keys.
+type Validator interface {
+	// Validate returns an error if `value` may not be stored at `key`.
+	Validate(key node.Key, value []byte) error
+
+	// Select returns the index of the best of `values`, which are all
+	// valid for `key`, ordered from least to most recently received.
+	Select(key node.Key, values [][]byte) (int, error)
+}
+
+// acceptLatest is the default Validator. It accepts any value,
+// and prefers the most recently received one.
+type acceptLatest struct{}
+
+func (acceptLatest) Validate(key node.Key, value []byte) error {
+	return nil
+}
+
+func (acceptLatest) Select(key node.Key, values [][]byte) (int, error) {
+	return len(values) - 1, nil
+}
+
+// PutKey stores `value` at `key` in `peer`'s storage, as published by `peer`.
+// It does not expire.
+func (peer *Peer) PutKey(key node.Key, value []byte) error {
+	return peer.putMutable(key, value, peer.Contact.Key, time.Time{})
+}
+
+// putMutable stores `value` at `key`, published by `publisher`, that expires
+// at `expires`, or never if it is zero. The value must be valid, and is not
+// stored if the validator prefers the value that is already there. Signed
+// items can only be replaced by newer signed items, see putItem.
+func (peer *Peer) putMutable(key node.Key, value []byte, publisher node.Key, expires time.Time) error {
+	if err := peer.validator.Validate(key, value); err != nil {
+		return errors.Wrap(err, "invalid value")
+	}
+	keyStr := encoding.EncodeHash(key)
+	now := time.Now()
+
+	peer.storing.Lock()
+	defer peer.storing.Unlock()
+
+	if record, err := peer.store.GetRecord(keyStr); err == nil && !record.Expired(now) {
+		if record.Signed {
+			return errors.New("key holds a signed item")
+		}
+		best, err := peer.validator.Select(key, [][]byte{record.Data, value})
+		if err != nil {
+			return err
+		}
+		if best == 0 {
+			return nil
+		}
+	}
+	_, err := peer.store.PutRecord(store.Record{
+		Key:       keyStr,
+		Data:      value,
+		Publisher: publisher,
+		Received:  now,
+		Expires:   expires,
+	})
+	return err
+}
+
+// IterativeStoreKey finds the <=k closest nodes to `key` and stores `value`
+// at `key` in each of them, like IterativeStoreContext does for immutable data.
+func (peer *Peer) IterativeStoreKey(ctx context.Context, key node.Key, value []byte, quorum int) (*StoreResult, error) {
+	return peer.iterativeStore(ctx, key, store.Record{
+		Key:  encoding.EncodeHash(key),
+		Data: value,
+	}, quorum, 0)
+}
+
+// IterativeFindKey attempts to find the value at the mutable `key`. It is
+// like IterativeFindValueContext, except that the value is checked by the
+// validator rather than against its hash, and that it is not cached along
+// the lookup path, where it could go stale. A signed item is checked by its
+// signature instead, and returned encoded; it may not be the latest version,
+// which IterativeFindItem finds.
+func (peer *Peer) IterativeFindKey(ctx context.Context, key node.Key) ([]byte, []node.Contact, error) {
+	data, list, err := peer.findValue(ctx, key, func(res *MessageResponseFindValue) error {
+		if res.Signed {
+			_, err := decodeItem(key, res.Data)
+			return err
+		}
+		return peer.validator.Validate(key, res.Data)
+	})
+	if data != nil {
+		return data, nil, nil
+	}
+	return nil, list.results(), errors.Wrap(err, "find key lookup stopped")
+}
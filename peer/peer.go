@@ -1,50 +1,88 @@
 package peer
 
 import (
+	"context"
+	"crypto/ed25519"
 	"fmt"
+	"sync"
 	"time"
 
-	"github.com/askft/kademlia/intset"
+	"github.com/pkg/errors"
+
 	"github.com/askft/kademlia/node"
 	"github.com/askft/kademlia/store"
 )
 
-// Bucket is a list of contacts. Note that a bucket
-// should maximally hold `k` elements.
-type Bucket []node.Contact
-
 // Peer keeps track of relevant state for the Kademlia network.
 type Peer struct {
-	Contact      node.Contact
-	store        store.Store
-	networkID    string                      // Prevents networks merging together.
-	routingTable [node.KeySizeBits]Bucket    // Every bucket corresponds to a specific distance.
-	refreshMap   [node.KeySizeBits]time.Time // TODO Look closer into when/where to refresh.
-	// mutex        sync.Mutex                // TODO Use RWMutex instead? And check carefully where this might be needed.
+	params
+	Contact    node.Contact
+	privateKey ed25519.PrivateKey // Signs messages, if the peer has a key pair.
+	store      store.RecordStore
+	networkID  string         // Prevents networks merging together.
+	table      *RoutingTable  // Every bucket corresponds to a specific distance.
+	tableFile  string         // Where the routing table is saved, if anywhere.
+	storing    sync.Mutex     // Makes updates of records in the store atomic.
+	validator  Validator      // Checks mutable values.
+	quit       chan struct{}  // Closed to stop background jobs.
+	jobs       sync.WaitGroup // Background jobs started by Start.
 }
 
 // NewPeer initializes a peer and returns a handle to it.
+// It returns an error if the protocol parameters in `options` are invalid.
 func NewPeer(options *Options) (*Peer, error) {
+	params, err := options.params()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid options")
+	}
+	contact := node.Contact{
+		Key:   options.Key,
+		Host:  options.Host,
+		Port:  options.Port,
+		Proof: options.Proof,
+	}
+	if options.PrivateKey != nil {
+		contact.PublicKey = options.PrivateKey.Public().(ed25519.PublicKey)
+	}
+	if params.secure {
+		if err := params.puzzle.Verify(contact); err != nil {
+			return nil, errors.Wrap(err, "insecure identity")
+		}
+	}
+	validator := options.Validator
+	if validator == nil {
+		validator = acceptLatest{}
+	}
 	return &Peer{
-		Contact: node.Contact{
-			Key:  options.Key,
-			Host: options.Host,
-			Port: options.Port,
-		},
-		store:        options.Store,
-		networkID:    options.NetworkID,
-		routingTable: [node.KeySizeBits]Bucket{},
-		refreshMap:   [node.KeySizeBits]time.Time{},
+		params:     params,
+		validator:  validator,
+		Contact:    contact,
+		privateKey: options.PrivateKey,
+		store:      store.WithRecords(options.Store),
+		networkID:  options.NetworkID,
+		table:      NewRoutingTable(options.Key, params.k, params.b, options.IPLimits),
+		tableFile:  options.TableFile,
+		quit:       make(chan struct{}),
 	}, nil
 }
 
 // Bootstrap lets `peer` join a network using a predefined set of nodes.
-//  See http://xlattice.sourceforge.net/components/protocol/kademlia/specs.html#join
-func (peer *Peer) Bootstrap(bootstrapContact node.Contact) {
+// It returns an error if the bootstrap node could not be reached.
+//
+//	See http://xlattice.sourceforge.net/components/protocol/kademlia/specs.html#join
+func (peer *Peer) Bootstrap(bootstrapContact node.Contact) error {
 
-	// Add the bootstrap node into this peer's appropriate bucket.
-	peer.UpdateTable(bootstrapContact)
+	// Ping the bootstrap node, which adds it into this peer's
+	// appropriate bucket if it responds.
+	if _, err := peer.SendPing(context.Background(), bootstrapContact); err != nil {
+		return errors.Wrap(err, "could not reach bootstrap node")
+	}
+	peer.join()
+	return nil
+}
 
+// join looks up the peer's own key among the contacts already in its table.
+func (peer *Peer) join() {
 	// Perform a self-lookup against the known nodes, of which the just
 	// added bootstrap node is the only one. This populates other peers'
 	// k-buckets with this peer, [[[and populates this peer's k-buckets with
@@ -53,7 +91,7 @@ func (peer *Peer) Bootstrap(bootstrapContact node.Contact) {
 
 	// Populate this peer's table with the found contacts.
 	for _, contact := range contacts {
-		q := peer.bucketIndex(contact.Key)
+		q := peer.table.BucketIndex(contact.Key)
 		peer.RefreshBucket(q)
 		peer.UpdateTable(contact)
 	}
@@ -61,8 +99,8 @@ func (peer *Peer) Bootstrap(bootstrapContact node.Contact) {
 
 // PrintAllContacts prints all contacts known to this peer.
 func (peer *Peer) PrintAllContacts() {
-	for _, bucket := range peer.routingTable {
-		for _, contact := range bucket {
+	for _, bucket := range peer.table.Snapshot() {
+		for _, contact := range bucket.Contacts {
 			fmt.Println(" -", contact)
 		}
 	}
@@ -70,52 +108,37 @@ func (peer *Peer) PrintAllContacts() {
 
 // RefreshBucket resets the last refresh time for bucket number `q`.
 func (peer *Peer) RefreshBucket(q int) {
-	peer.refreshMap[q] = time.Now()
+	peer.table.Touch(q)
 }
 
 // FindClosest finds the `n` closest contacts to `target` in
-// the peer's routing table.
+// the peer's routing table, sorted by ascending distance.
 func (peer *Peer) FindClosest(target node.Key, n int) []node.Contact {
-	d := peer.Contact.Key.Distance(target)
-	closest := []node.Contact{}
-	seq := intset.New()
-	seq.AddMany(node.FindSetBits(d[:]))
-
-	// Descend through 1-bits in `d` toward 0 and try to fill `closest`.
-	for _, q := range seq.SortedReverse() {
-		bucket := peer.routingTable[q]
-		if tryFill(&closest, bucket, n) {
-			fmt.Println("Filled up `closest` at bucket", q)
-			break
-		}
-	}
-
-	// If `closest` is still not filled, search unvisisted buckets [0, 160).
-	for q := 0; q < node.KeySizeBits; q++ {
-		if !seq.Has(q) {
-			bucket := peer.routingTable[q]
-			if tryFill(&closest, bucket, n) {
-				fmt.Println("Filled up `closest` at bucket", q)
-				break
-			}
-		}
-	}
-	return closest
+	return peer.table.Closest(target, n)
 }
 
-func tryFill(closest *[]node.Contact, bucket Bucket, n int) bool {
-	for _, contact := range bucket {
-		*closest = append(*closest, contact)
-		if len(*closest) == n {
-			return true
-		}
-	}
-	return false
+// Table returns the peer's routing table.
+func (peer *Peer) Table() *RoutingTable {
+	return peer.table
 }
 
 // UpdateTable adds `contact` into `peer`'s appropriate bucket if necessary.
+// In secure mode, contacts whose keys are not verified are ignored. If
+// `contact` competes with a member of the bucket for its place, UpdateTable
+// pings that member before it returns.
 func (peer *Peer) UpdateTable(contact node.Contact) {
-	bucket := peer.bucketFor(contact.Key)
+	if check := peer.addContact(contact); check != nil {
+		check()
+	}
+}
+
+// addContact is like UpdateTable, except that it returns the ping of the
+// member that `contact` competes with, if any, rather than waiting for it.
+func (peer *Peer) addContact(contact node.Contact) func() {
+	if err := peer.verifyKey(contact); err != nil {
+		fmt.Println("UpdateTable (rejected):", err)
+		return nil
+	}
 
 	printUpdate := func(action string) {
 		fmt.Printf(
@@ -124,74 +147,113 @@ func (peer *Peer) UpdateTable(contact node.Contact) {
 				" - remote: %s\n"+
 				" - bucket: %d\n"+
 				"\n",
-			action, peer.Contact, contact, peer.bucketIndex(contact.Key),
+			action, peer.Contact, contact, peer.table.BucketIndex(contact.Key),
 		)
 	}
 
-	// If the contact already exists, move it to the end of the bucket.
-	for i, c := range *bucket {
-		if c.Key == contact.Key {
-			bucket.moveToTail(i)
-			printUpdate("tail move")
-			return
-		}
-	}
-
-	// If the bucket has space, add the new contact to the bucket.
-	if len(*bucket) < k {
-		bucket.addToTail(contact)
+	member, result := peer.table.Add(contact)
+	switch result {
+	case Added:
 		printUpdate("tail add")
-		return
+		return nil
+	case Limited:
+		printUpdate("over IP limits")
+		return nil
+	case Moved:
+		// `contact` claims the key of a known contact from another address.
+		// It only takes the place of the known contact if that one is gone.
+		return func() {
+			if !peer.alive(member) {
+				peer.RemoveContact(member.Key)
+			}
+			printUpdate("moved")
+		}
+	case Slow:
+		// `contact` is much faster than the slowest member of its bucket.
+		// It only takes the place of that member if a fresh ping confirms
+		// that the member is still slow, or if the member is gone.
+		return func() {
+			start := time.Now()
+			if !peer.alive(member) {
+				peer.RemoveContact(member.Key)
+			} else if time.Since(start) > slowFactor*contact.RTT {
+				peer.table.Demote(member.Key, contact.Key)
+			}
+			printUpdate("slow")
+		}
 	}
 
-	// If the bucket is full, ping its head and replace it iff
-	// it did not respond within a reasonable time.
-	pingChan := make(chan MessageResponsePing)
-	peer.SendPing(contact, (*bucket)[0].Key, pingChan) // TODO just send Contact, see client.go
-	select {
-	case res := <-pingChan:
-		fmt.Println("got ping back:", res)
-		bucket.moveToTail(0)
-	case <-time.After(updateTimeout * time.Millisecond):
-		fmt.Println("ping timed out")
-		bucket.replace(0, contact) // Replace first item...
-		bucket.moveToTail(0)       // ... and move it to the tail.
+	// If the bucket is full, `contact` was kept as a replacement candidate.
+	// Ping the head of the bucket. If it did not respond within a reasonable
+	// time, or another node answered at its address, it is evicted, and the
+	// most recently seen replacement (usually `contact`) takes its place.
+	// SendPing moves the head to the tail of the bucket if it does respond.
+	return func() {
+		if !peer.alive(member) {
+			peer.RemoveContact(member.Key)
+		}
+		printUpdate("ping")
 	}
-	printUpdate("ping")
 }
 
-// Bucket operations ---------------------------------------------------------
-
-func (peer *Peer) bucketFor(key node.Key) *Bucket {
-	return &peer.routingTable[peer.bucketIndex(key)]
-}
-
-func (peer *Peer) bucketIndex(key node.Key) int {
-	return node.KeySizeBits - 1 - peer.Contact.Key.Distance(key).PrefixLength()
-}
-
-func (bucket *Bucket) replace(i int, contact node.Contact) {
-	(*bucket)[i] = contact
+// alive pings `contact` and reports whether it answered with its own key.
+func (peer *Peer) alive(contact node.Contact) bool {
+	res, err := peer.SendPing(context.Background(), contact)
+	if err != nil {
+		fmt.Println("ping failed:", err)
+		return false
+	}
+	if res.Sender.Key != contact.Key {
+		fmt.Println("ping answered by another node:", res.Sender)
+		return false
+	}
+	return true
 }
 
-func (bucket *Bucket) moveToTail(i int) {
-	*bucket = append((*bucket)[:i], append((*bucket)[i+1:], (*bucket)[i])...)
+// verifyKey returns an error if the peer is in secure mode and the key
+// of `contact` is not derived from its public key or does not solve
+// the puzzles. That the contact holds the matching private key is only
+// shown by a signed message, see verifyMessage.
+func (peer *Peer) verifyKey(contact node.Contact) error {
+	if !peer.secure {
+		return nil
+	}
+	return peer.puzzle.Verify(contact)
 }
 
-func (bucket *Bucket) addToTail(contact node.Contact) {
-	*bucket = append(*bucket, contact)
+// RemoveContact removes the contact with `key` from the routing table.
+// The most recently seen replacement candidate in the same bucket, if any,
+// is promoted to take its place.
+func (peer *Peer) RemoveContact(key node.Key) {
+	peer.table.Remove(key)
 }
 
 // Store operations ----------------------------------------------------------
 
-// Put stores `value` in `peer`'s storage.
+// Put stores `value` in `peer`'s storage, as published by `peer`.
+// It does not expire.
 func (peer *Peer) Put(value []byte) (string, error) {
-	return peer.store.Put(value)
+	return peer.putRegular(value, peer.Contact.Key, time.Time{})
 }
 
 // Get returns the value at `key` in `peer`'s storage if it exists.
 func (peer *Peer) Get(key string) ([]byte, error) {
-	return peer.store.Get(key)
+	record, err := peer.Record(key)
+	return record.Data, err
+}
+
+// Record returns the value at `key` in `peer`'s storage together with its
+// metadata, if it exists. Expired values that have not yet been deleted by
+// the sweeper are treated as missing.
+func (peer *Peer) Record(key string) (store.Record, error) {
+	record, err := peer.store.GetRecord(key)
+	if err != nil {
+		return store.Record{}, err
+	}
+	if record.Expired(time.Now()) {
+		return store.Record{}, errors.Errorf("value at %s has expired", key)
+	}
+	return record, nil
 }
 
 // Delete removes the value at `key` from `peer`'s storage.
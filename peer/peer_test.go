@@ -1,9 +1,20 @@
 package peer
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/askft/kademlia/encoding"
 	"github.com/askft/kademlia/node"
+	"github.com/askft/kademlia/store"
 )
 
 func init() {}
@@ -25,6 +36,240 @@ func TestXorDistancePrefixLength(t *testing.T) {
 	assertEqual(t, a.Distance(b).PrefixLength(), 0)
 }
 
+func TestSaveAndRestoreTable(t *testing.T) {
+	a, server := newTestPeer(t)
+	defer server.Close()
+	b, server := newTestPeer(t)
+	defer server.Close()
+	dead, server := newTestPeer(t)
+	server.Close()
+
+	a.UpdateTable(b.Contact)
+	a.UpdateTable(dead.Contact)
+
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "table.json")
+	if err := a.SaveTable(path); err != nil {
+		t.Fatal(err)
+	}
+
+	contacts, err := LoadContacts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(contacts), 2)
+
+	c, server := newTestPeer(t)
+	defer server.Close()
+	n, err := c.RestoreTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, n, 1)
+	assertEqual(t, c.FindClosest(b.Contact.Key, 1)[0].Key, b.Contact.Key)
+}
+
+func TestRPCErrorKinds(t *testing.T) {
+	p, server := newTestPeer(t)
+	defer server.Close()
+	dead, server := newTestPeer(t)
+	server.Close()
+
+	_, err := p.SendPing(context.Background(), dead.Contact)
+	assertEqual(t, IsUnreachable(err), true)
+
+	other, server := newTestPeer(t)
+	defer server.Close()
+	other.networkID = "other"
+	_, err = p.SendPing(context.Background(), other.Contact)
+	assertEqual(t, IsProtocolMismatch(err), true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+	_, err = p.SendPing(ctx, other.Contact)
+	assertEqual(t, IsTimeout(err), true)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = p.SendPing(ctx, other.Contact)
+	assertEqual(t, err, context.Canceled)
+}
+
+func TestRemoteErrorsAreNotFailures(t *testing.T) {
+	p, server := newTestPeer(t)
+	defer server.Close()
+	holder, server := newTestPeer(t)
+	defer server.Close()
+
+	// A live contact that keeps refusing to store is not stale.
+	assertEqual(t, holder.PutKey(encoding.HashData([]byte("name")), []byte("value")), nil)
+	p.UpdateTable(holder.Contact)
+	for i := 0; i < staleThreshold; i++ {
+		_, err := p.SendStore(context.Background(), holder.Contact, []byte("name"), 0)
+		assertEqual(t, IsRemoteError(err), true)
+	}
+	closest := p.FindClosest(holder.Contact.Key, 1)
+	assertEqual(t, len(closest), 1)
+	assertEqual(t, closest[0].Failures, 0)
+}
+
+func TestUpdateTableEvictsReusedAddress(t *testing.T) {
+	p, err := NewPeer(&Options{Key: testFarKey(0), K: 1, Alpha: 1, Store: store.NewMemStore(), NetworkID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, server := newTestPeer(t)
+	defer server.Close()
+
+	// The head of the bucket is gone, and another node now has its address.
+	head := other.Contact
+	head.Key = testFarKey(2)
+	p.table.Add(head)
+	p.UpdateTable(node.Contact{Key: testFarKey(3)})
+	contacts := p.Table().Bucket(p.Table().BucketIndex(head.Key)).Contacts
+	assertEqual(t, len(contacts), 1)
+	assertEqual(t, contacts[0].Key, testFarKey(3))
+}
+
+func TestUpdateTableMovedContact(t *testing.T) {
+	p, server := newTestPeer(t)
+	defer server.Close()
+	other, server := newTestPeer(t)
+	defer server.Close()
+	dead, server := newTestPeer(t)
+	server.Close()
+
+	// A message that claims the key of a live contact from another
+	// address does not replace it.
+	p.UpdateTable(other.Contact)
+	spoofed := other.Contact
+	spoofed.Host, spoofed.Port = dead.Contact.Host, dead.Contact.Port
+	p.UpdateTable(spoofed)
+	bucket := p.Table().Bucket(p.Table().BucketIndex(other.Contact.Key))
+	assertEqual(t, len(bucket.Contacts), 1)
+	assertEqual(t, bucket.Contacts[0].Address(), other.Contact.Address())
+	assertEqual(t, len(bucket.Replacements), 0)
+
+	// A node that has moved away from a dead address replaces its old entry.
+	moved := dead.Contact
+	moved.Host, moved.Port = other.Contact.Host, other.Contact.Port
+	p.UpdateTable(dead.Contact)
+	p.UpdateTable(moved)
+	closest := p.FindClosest(dead.Contact.Key, 1)
+	assertEqual(t, closest[0].Key, dead.Contact.Key)
+	assertEqual(t, closest[0].Address(), other.Contact.Address())
+}
+
+func TestUpdateTablePingsSlowMember(t *testing.T) {
+	live, server := newTestPeer(t)
+	defer server.Close()
+	dead, server := newTestPeer(t)
+	server.Close()
+
+	// A member that looked slow once is kept if it answers quickly now,
+	// and makes room for a much faster newcomer if it is gone.
+	for _, member := range []*Peer{live, dead} {
+		p, err := NewPeer(&Options{K: 1, Alpha: 1, Store: store.NewMemStore(), NetworkID: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		slow := member.Contact
+		slow.RTT = time.Hour
+		p.table.Add(slow)
+		newcomer := node.Contact{Key: slow.Key, RTT: time.Second}
+		newcomer.Key[len(newcomer.Key)-1] ^= 1
+		p.UpdateTable(newcomer)
+
+		contacts := p.Table().Bucket(p.Table().BucketIndex(slow.Key)).Contacts
+		assertEqual(t, len(contacts), 1)
+		if member == live {
+			assertEqual(t, contacts[0].Key, slow.Key)
+		} else {
+			assertEqual(t, contacts[0].Key, newcomer.Key)
+		}
+	}
+}
+
+func TestAcceptDoesNotWaitForPings(t *testing.T) {
+	p, err := NewPeer(&Options{K: 1, Alpha: 1, Store: store.NewMemStore(), NetworkID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	silent, listener := newSilentContact(t)
+	defer listener.Close()
+	p.table.Add(silent)
+
+	// The head of the full bucket takes `pingTimeout` to fail its ping,
+	// which the sender should not have to wait for.
+	sender := node.Contact{Key: silent.Key}
+	sender.Key[len(sender.Key)-1] ^= 1
+	req := &MessageRequestPing{createCommonWithNonce(sender, p.networkID)}
+	start := time.Now()
+	assertEqual(t, (&RPC{peer: p}).RecvPing(req, &MessageResponsePing{}), nil)
+	if elapsed := time.Since(start); elapsed >= p.pingTimeout/2 {
+		t.Errorf("RecvPing took %s.", elapsed)
+	}
+}
+
+func TestResponderAddressIsDialed(t *testing.T) {
+	p, server := newTestPeer(t)
+	defer server.Close()
+	other, server := newTestPeer(t)
+	defer server.Close()
+
+	// `other` claims 127.0.0.1, but is reached at 127.0.0.2.
+	dialed := other.Contact
+	dialed.Host = net.ParseIP("127.0.0.2")
+	if _, err := p.SendPing(context.Background(), dialed); err != nil {
+		t.Fatal(err)
+	}
+	closest := p.FindClosest(other.Contact.Key, 1)
+	assertEqual(t, len(closest), 1)
+	assertEqual(t, closest[0].Address(), dialed.Address())
+}
+
+func TestAcceptUsesConnectionHost(t *testing.T) {
+	p, server := newTestPeer(t)
+	defer server.Close()
+	client, err := NewPeer(&Options{
+		Key:       testFarKey(1),
+		Host:      net.ParseIP("10.0.0.1"),
+		Port:      "4000",
+		Store:     store.NewMemStore(),
+		NetworkID: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client claims 10.0.0.1, but connects from 127.0.0.1.
+	if _, err := client.SendPing(context.Background(), p.Contact); err != nil {
+		t.Fatal(err)
+	}
+	closest := p.FindClosest(client.Contact.Key, 1)
+	assertEqual(t, len(closest), 1)
+	assertEqual(t, closest[0].Address(), "127.0.0.1:4000")
+}
+
+func TestAcceptIgnoresClaimedRTT(t *testing.T) {
+	p, server := newTestPeer(t)
+	defer server.Close()
+
+	sender := node.Contact{Key: testFarKey(1), RTT: time.Nanosecond, Failures: 3}
+	req := &MessageRequestPing{createCommonWithNonce(sender, p.networkID)}
+	assertEqual(t, (&RPC{peer: p}).RecvPing(req, &MessageResponsePing{}), nil)
+
+	contacts := p.Table().Bucket(p.Table().BucketIndex(sender.Key)).Contacts
+	assertEqual(t, len(contacts), 1)
+	assertEqual(t, contacts[0].RTT, time.Duration(0))
+	assertEqual(t, contacts[0].Failures, 0)
+}
+
 func assertEqual(t *testing.T, value, expected interface{}) {
 	if value != expected {
 		t.Errorf("Expected %v, got %v.\n", expected, value)
@@ -37,3 +282,219 @@ func assertNotEqual(t *testing.T, value, expected interface{}) {
 			expected, value)
 	}
 }
+
+func TestOptionsParams(t *testing.T) {
+	params, err := (&Options{}).params()
+	assertEqual(t, err, nil)
+	assertEqual(t, params.k, defaultK)
+	assertEqual(t, params.α, defaultAlpha)
+	assertEqual(t, params.pingTimeout, defaultPingTimeout)
+	assertEqual(t, params.rpcTimeout, defaultRPCTimeout)
+
+	params, err = (&Options{K: 4, Alpha: 2, RPCTimeout: time.Second}).params()
+	assertEqual(t, err, nil)
+	assertEqual(t, params.k, 4)
+	assertEqual(t, params.α, 2)
+	assertEqual(t, params.rpcTimeout, time.Second)
+
+	for _, options := range []Options{
+		{K: -1},
+		{Alpha: -1},
+		{PingTimeout: -time.Second},
+		{RPCTimeout: -time.Second},
+		{K: 2, Alpha: 3},
+	} {
+		_, err := NewPeer(&options)
+		assertNotEqual(t, err, nil)
+	}
+}
+
+func TestSmallBuckets(t *testing.T) {
+	p, err := NewPeer(&Options{K: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		p.Table().Add(node.Contact{Key: testFarKey(byte(i))})
+	}
+	bucket := p.Table().Bucket(p.Table().BucketIndex(testFarKey(0)))
+	assertEqual(t, len(bucket.Contacts), 4)
+	assertEqual(t, len(bucket.Replacements), 2)
+	assertEqual(t, len(p.FindClosest(node.Key{}, p.k)), 4)
+}
+
+func TestTableSnapshot(t *testing.T) {
+	peers, stop := newTestNetwork(t, 4)
+	defer stop()
+
+	snapshot := peers[1].TableSnapshot()
+	assertEqual(t, snapshot.Key, peers[1].Contact.Key.String())
+	contacts := 0
+	for _, bucket := range snapshot.Buckets {
+		assertEqual(t, bucket.Index, peers[1].Table().BucketIndex(mustDecodeKey(t, bucket.Contacts[0].Key)))
+		contacts += len(bucket.Contacts)
+	}
+	assertEqual(t, contacts, peers[1].Table().Len())
+
+	data, err := snapshot.JSON()
+	assertEqual(t, err, nil)
+	decoded := &TableSnapshot{}
+	assertEqual(t, json.Unmarshal(data, decoded), nil)
+	assertEqual(t, len(decoded.Buckets), len(snapshot.Buckets))
+
+	snapshots := []*TableSnapshot{}
+	edges := 0
+	for _, p := range peers {
+		snapshots = append(snapshots, p.TableSnapshot())
+		edges += p.Table().Len()
+	}
+	graph := MergeSnapshots(snapshots...)
+	assertEqual(t, len(graph.Nodes), 4)
+	assertEqual(t, len(graph.Edges), edges)
+
+	b := &strings.Builder{}
+	assertEqual(t, graph.WriteDOT(b), nil)
+	dot := b.String()
+	assertEqual(t, strings.HasPrefix(dot, "digraph kademlia {"), true)
+	assertEqual(t, strings.Count(dot, " -> "), edges)
+}
+
+func mustDecodeKey(t *testing.T, s string) node.Key {
+	key, err := encoding.DecodeKeyStr(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSecureIDs(t *testing.T) {
+	puzzle := node.Puzzle{StaticBits: 2, DynamicBits: 2}
+	newSecurePeer := func(id *node.Identity) (*Peer, error) {
+		return NewPeer(&Options{
+			Key:        id.Key,
+			PrivateKey: id.PrivateKey,
+			Proof:      id.Proof,
+			Host:       net.ParseIP("127.0.0.1"),
+			Port:       "0",
+			Store:      store.NewMemStore(),
+			NetworkID:  "test",
+			SecureIDs:  true,
+			Puzzle:     puzzle,
+		})
+	}
+
+	// A peer must itself have a verified key.
+	_, err := newSecurePeer(node.NewIdentity())
+	assertNotEqual(t, err, nil)
+
+	id, err := node.NewSecureIdentity(puzzle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secure, err := newSecurePeer(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(secure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go server.Run(&wg)
+
+	// A peer with a chosen key can talk to the secure peer,
+	// but is not added to its routing table.
+	sybil, server := newTestPeer(t)
+	defer server.Close()
+	assertEqual(t, sybil.Bootstrap(secure.Contact), nil)
+	assertEqual(t, secure.Table().Len(), 0)
+	assertEqual(t, sybil.Table().Len(), 1)
+
+	// Nor is it taken from FIND_NODE responses during lookups.
+	other, err := node.NewSecureIdentity(puzzle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	honest := node.Contact{Key: other.Key, PublicKey: other.PublicKey(), Proof: other.Proof}
+	contacts := secure.withLocalRTT([]node.Contact{sybil.Contact, honest})
+	assertEqual(t, len(contacts), 1)
+	assertEqual(t, contacts[0].Key, honest.Key)
+
+	// A peer that copies the public key and proof of another
+	// can't sign its messages, and is not added either.
+	impostor, server := newTestPeer(t)
+	defer server.Close()
+	impostor.Contact.Key = honest.Key
+	impostor.Contact.PublicKey = honest.PublicKey
+	impostor.Contact.Proof = honest.Proof
+	_, err = impostor.SendPing(context.Background(), secure.Contact)
+	assertEqual(t, err, nil)
+	assertEqual(t, secure.Table().Len(), 0)
+
+	// Nor does a secure peer accept its responses.
+	_, err = secure.SendPing(context.Background(), impostor.Contact)
+	assertEqual(t, IsProtocolMismatch(err), true)
+	assertEqual(t, secure.Table().Len(), 0)
+
+	// The owner of the key pair is added.
+	owner, err := newSecurePeer(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = owner.SendPing(context.Background(), secure.Contact)
+	assertEqual(t, err, nil)
+	assertEqual(t, secure.Table().Len(), 1)
+	assertEqual(t, owner.Table().Len(), 1)
+}
+
+func TestRecordMetadata(t *testing.T) {
+	p, server := newTestPeer(t)
+	defer server.Close()
+	holder, server := newTestPeer(t)
+	defer server.Close()
+
+	// Values put locally are published by the peer and never expire.
+	key, err := holder.Put([]byte("local"))
+	assertEqual(t, err, nil)
+	record, err := holder.Record(key)
+	assertEqual(t, err, nil)
+	assertEqual(t, record.Publisher, holder.Contact.Key)
+	assertEqual(t, record.Expires.IsZero(), true)
+
+	// Values received in a STORE are published by the sender and expire.
+	_, err = p.SendStore(context.Background(), holder.Contact, []byte("remote"), 0)
+	assertEqual(t, err, nil)
+	record, err = holder.Record(encoding.EncodeData([]byte("remote")))
+	assertEqual(t, err, nil)
+	assertEqual(t, record.Publisher, p.Contact.Key)
+	assertEqual(t, record.Cached, false)
+	assertEqual(t, record.Expires.After(time.Now()), true)
+
+	// A cached copy does not replace a regular one.
+	_, err = p.SendStore(context.Background(), holder.Contact, []byte("local"), time.Millisecond)
+	assertEqual(t, err, nil)
+	record, err = holder.Record(key)
+	assertEqual(t, err, nil)
+	assertEqual(t, record.Cached, false)
+	assertEqual(t, record.Expires.IsZero(), true)
+
+	// A cached copy lives no longer than a regular one.
+	_, err = p.SendStore(context.Background(), holder.Contact, []byte("forever"), 1000*timeOptions.Expire)
+	assertEqual(t, err, nil)
+	record, err = holder.Record(encoding.EncodeData([]byte("forever")))
+	assertEqual(t, err, nil)
+	assertEqual(t, record.Expires.After(time.Now().Add(timeOptions.Expire)), false)
+	assertEqual(t, holder.Delete(encoding.EncodeData([]byte("forever"))), nil)
+
+	// Expired records are deleted by the sweeper.
+	_, err = p.SendStore(context.Background(), holder.Contact, []byte("cached"), time.Millisecond)
+	assertEqual(t, err, nil)
+	time.Sleep(10 * time.Millisecond)
+	keys, _ := holder.store.Keys()
+	assertEqual(t, len(keys), 3)
+	assertEqual(t, holder.sweep(), nil)
+	keys, _ = holder.store.Keys()
+	assertEqual(t, len(keys), 2)
+}
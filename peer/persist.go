@@ -0,0 +1,158 @@
+package peer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/askft/kademlia/encoding"
+	"github.com/askft/kademlia/node"
+)
+
+// savedContact is the on-disk representation of a contact.
+type savedContact struct {
+	Key       string        `json:"key"`
+	Address   string        `json:"address"`
+	LastSeen  time.Time     `json:"last_seen"`
+	RTT       time.Duration `json:"rtt"`
+	PublicKey []byte        `json:"public_key,omitempty"`
+	Proof     string        `json:"proof,omitempty"`
+}
+
+// SaveTable writes the contacts in the routing table to the file at `path`.
+// The file is replaced atomically so that a crash never leaves it truncated.
+func (peer *Peer) SaveTable(path string) error {
+	saved := []savedContact{}
+	for _, bucket := range peer.table.Snapshot() {
+		for _, contact := range bucket.Contacts {
+			s := savedContact{
+				Key:      contact.Key.String(),
+				Address:  contact.Address(),
+				LastSeen: contact.LastSeen,
+				RTT:      contact.RTT,
+			}
+			if contact.PublicKey != nil {
+				s.PublicKey = contact.PublicKey
+				s.Proof = contact.Proof.String()
+			}
+			saved = append(saved, s)
+		}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadContacts reads contacts saved by SaveTable from the file at `path`,
+// ordered from least to most recently seen.
+func LoadContacts(path string) ([]node.Contact, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	saved := []savedContact{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, errors.Wrapf(err, "could not parse %s", path)
+	}
+	contacts := []node.Contact{}
+	for _, s := range saved {
+		key, err := encoding.DecodeKeyStr(s.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %s", s.Key)
+		}
+		host, port, err := net.SplitHostPort(s.Address)
+		if err != nil {
+			return nil, err
+		}
+		contact := node.Contact{
+			Key:       key,
+			Host:      net.ParseIP(host),
+			Port:      port,
+			LastSeen:  s.LastSeen,
+			RTT:       s.RTT,
+			PublicKey: s.PublicKey,
+		}
+		if s.Proof != "" {
+			if contact.Proof, err = encoding.DecodeKeyStr(s.Proof); err != nil {
+				return nil, errors.Wrapf(err, "invalid proof %s", s.Proof)
+			}
+		}
+		contacts = append(contacts, contact)
+	}
+	sort.SliceStable(contacts, func(i, j int) bool {
+		return contacts[i].LastSeen.Before(contacts[j].LastSeen)
+	})
+	return contacts, nil
+}
+
+// RestoreTable loads the contacts saved at `path` and pings each of them.
+// Contacts that respond with the expected key are added to the routing
+// table, after which the peer looks itself up to rejoin the network.
+// It returns the number of contacts that were restored.
+func (peer *Peer) RestoreTable(path string) (int, error) {
+	contacts, err := LoadContacts(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	alive := make([]bool, len(contacts))
+	var wg sync.WaitGroup
+	for i, contact := range contacts {
+		wg.Add(1)
+		go func(i int, contact node.Contact) {
+			defer wg.Done()
+			alive[i] = peer.verify(contact)
+		}(i, contact)
+	}
+	wg.Wait()
+
+	// Add the verified contacts in the order they were last seen,
+	// so that buckets keep their least-recently-seen ordering.
+	n := 0
+	for i, contact := range contacts {
+		if alive[i] {
+			peer.UpdateTable(contact)
+			n++
+		}
+	}
+	if n > 0 {
+		peer.join()
+	}
+	return n, nil
+}
+
+// verify pings `contact` and reports whether it responded in
+// time and with the key that it is known by.
+func (peer *Peer) verify(contact node.Contact) bool {
+	req := &MessageRequestPing{
+		MessageCommon: createCommonWithNonce(peer.Contact, peer.networkID),
+	}
+	res := &MessageResponsePing{}
+	err := peer.call(context.Background(), contact, "RPC.RecvPing", req, res, peer.pingTimeout)
+	return err == nil && res.Sender.Key == contact.Key
+}
@@ -0,0 +1,75 @@
+package peer
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/askft/kademlia/encoding"
+	"github.com/askft/kademlia/store"
+)
+
+/*
+	Keeping values alive in the network.
+
+	Every `timeOptions.Replicate`, a peer sends each value it holds to the
+	k closest nodes to its key, so that values survive as nodes leave and
+	join. A value that the peer itself received within the interval is
+	skipped, since the node that sent it has just done the same.
+
+	Every `timeOptions.Republish`, the original publisher of a value stores
+	it anew, which renews its expiry at the nodes that hold it.
+
+	See http://xlattice.sourceforge.net/components/protocol/kademlia/specs.html#replication
+*/
+
+// replicate sends every regular record in the store to the k closest
+// nodes to its key, keeping its original publisher and expiry. Records
+// received within the last `timeOptions.Replicate`, and records that this
+// peer published itself, are skipped.
+func (peer *Peer) replicate(ctx context.Context) error {
+	since := time.Now().Add(-timeOptions.Replicate)
+	return peer.storeEach(ctx, func(record store.Record) bool {
+		return record.Publisher != peer.Contact.Key && record.Received.Before(since)
+	})
+}
+
+// republish sends every record that this peer published to the k closest
+// nodes to its key, with a renewed expiry.
+func (peer *Peer) republish(ctx context.Context) error {
+	return peer.storeEach(ctx, func(record store.Record) bool {
+		return record.Publisher == peer.Contact.Key
+	})
+}
+
+// storeEach stores each regular record in the store for which `include`
+// returns true at the k closest nodes to its key. It stops early only if
+// `ctx` is done, and logs the records that could not be stored at all.
+func (peer *Peer) storeEach(ctx context.Context, include func(store.Record) bool) error {
+	keys, err := peer.store.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		record, err := peer.Record(key)
+		if err != nil || record.Cached || !include(record) {
+			continue
+		}
+		target, err := encoding.DecodeKeyStr(key)
+		if err != nil {
+			continue
+		}
+		if record.Publisher == peer.Contact.Key {
+			record.Expires = time.Time{} // Renewed at the receivers.
+		}
+		if _, err := peer.iterativeStore(ctx, target, record, 1, 0); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Println(errors.Wrapf(err, "could not store [ %s ]", key))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,469 @@
+package peer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/askft/kademlia/node"
+)
+
+// Bucket is a list of contacts ordered from least to most recently seen,
+// together with a cache of replacement candidates for when a contact goes
+// away. Note that a bucket should maximally hold `k` contacts and
+// as many replacements.
+type Bucket struct {
+	Contacts     []node.Contact
+	Replacements []node.Contact
+}
+
+// RoutingTable holds the k-buckets of a peer. It is safe for concurrent use.
+//
+// Keys are read as digits of `b` bits each. For every digit, the table has
+// a bucket for each of the 2^b - 1 values that the digit can take in the
+// distance to a contact whose distance starts with zero digits before it.
+// With b = 1 this is the usual layout of one bucket per bit, and with a
+// larger b a lookup resolves b bits per hop rather than one, at the cost of
+// a larger table. See section 4.2 of the paper.
+type RoutingTable struct {
+	mutex     sync.RWMutex
+	self      node.Key
+	k         int // Bucket size.
+	b         int // Bits per digit.
+	limits    IPLimits
+	buckets   []Bucket    // Every bucket corresponds to a specific range of distances.
+	refreshed []time.Time // Last time a lookup was made in each bucket's range.
+}
+
+// NewRoutingTable creates an empty routing table for the node with key
+// `self`, with buckets of size `k` that accept contacts within `limits`.
+// Keys are read as digits of `b` bits, which must divide the key size.
+func NewRoutingTable(self node.Key, k, b int, limits IPLimits) *RoutingTable {
+	n := node.KeySizeBits / b * (1<<uint(b) - 1)
+	rt := &RoutingTable{
+		self:      self,
+		k:         k,
+		b:         b,
+		limits:    limits,
+		buckets:   make([]Bucket, n),
+		refreshed: make([]time.Time, n),
+	}
+	now := time.Now()
+	for i := range rt.refreshed {
+		rt.refreshed[i] = now
+	}
+	return rt
+}
+
+// AddResult says what Add did with a contact.
+type AddResult int
+
+const (
+	// Added means that the contact is in its bucket.
+	Added AddResult = iota
+
+	// Full means that the bucket is full, so the contact is only kept
+	// as a replacement candidate. The caller should ping the head of
+	// the bucket and Remove it if it does not respond.
+	Full
+
+	// Limited means that the contact would exceed the IP limits of the
+	// table, so it is only kept as a replacement candidate.
+	Limited
+
+	// Moved means that the key of the contact is known at another address,
+	// so the contact is only kept as a replacement candidate. The caller
+	// should ping the known contact and Remove it if it does not respond.
+	Moved
+
+	// Slow means that the bucket is full, but one of its members is more
+	// than `slowFactor` times slower than the contact, which is kept as a
+	// replacement candidate. The caller should ping that member, Demote it
+	// if it is still slow, and Remove it if it does not respond.
+	Slow
+)
+
+// Add inserts `contact` at the tail of its bucket, or moves it there if it
+// is already present, and marks it as seen now with no failures. A non-zero
+// `contact.RTT` is taken as a new round-trip time sample, which is folded
+// into the smoothed round-trip time of the contact.
+//
+// A contact that is already present is only refreshed by a message from
+// the address it was added with, so that a message which claims the key of
+// another node can neither make the table point that key at the sender nor
+// keep a dead entry fresh. A contact at another address is kept as a
+// replacement candidate, and the known contact is returned together with
+// Moved. Once the old address fails, the candidate is promoted like any
+// other replacement.
+//
+// A new contact that would exceed the IP limits of the table is only kept
+// as a replacement candidate, and Limited is returned. If the bucket is
+// full, `contact` is kept as a replacement candidate. If one of the members
+// is more than `slowFactor` times slower than `contact`, that member is
+// returned together with Slow, and otherwise the head of the bucket is
+// returned together with Full.
+func (rt *RoutingTable) Add(contact node.Contact) (node.Contact, AddResult) {
+	if contact.Key == rt.self {
+		return node.Contact{}, Added
+	}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	contact.LastSeen = time.Now()
+	contact.Failures = 0
+	bucket := &rt.buckets[rt.bucketIndex(contact.Key)]
+
+	if i := bucket.indexOf(contact.Key); i >= 0 {
+		known := bucket.Contacts[i]
+		if known.Address() != contact.Address() {
+			bucket.addReplacement(contact, rt.k)
+			return known, Moved
+		}
+		known.LastSeen = contact.LastSeen
+		known.Failures = 0
+		known.RTT = smoothRTT(known.RTT, contact.RTT)
+		bucket.remove(i)
+		bucket.addToTail(known)
+		bucket.removeReplacement(known.Key)
+		return node.Contact{}, Added
+	}
+
+	if !rt.allowed(contact, bucket) {
+		bucket.addReplacement(contact, rt.k)
+		return node.Contact{}, Limited
+	}
+
+	if len(bucket.Contacts) < rt.k {
+		bucket.addToTail(contact)
+		bucket.removeReplacement(contact.Key)
+		return node.Contact{}, Added
+	}
+
+	bucket.addReplacement(contact, rt.k)
+	if i := bucket.slowest(); contact.RTT > 0 && bucket.Contacts[i].RTT > slowFactor*contact.RTT {
+		return bucket.Contacts[i], Slow
+	}
+	return bucket.Contacts[0], Full
+}
+
+// Demote moves the contact with `key` to the replacement cache of its
+// bucket, and promotes the replacement candidate with `candidate` to the
+// tail of the bucket in its place. It does nothing unless both are still
+// there and the candidate is within the IP limits, and returns true if it
+// did something.
+func (rt *RoutingTable) Demote(key, candidate node.Key) bool {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	bucket := &rt.buckets[rt.bucketIndex(key)]
+	i := bucket.indexOf(key)
+	j := bucket.indexOfReplacement(candidate)
+	if i < 0 || j < 0 {
+		return false
+	}
+	member, replacement := bucket.Contacts[i], bucket.Replacements[j]
+	bucket.remove(i)
+	if !rt.allowed(replacement, bucket) {
+		bucket.addToTail(member)
+		return false
+	}
+	bucket.addToTail(replacement)
+	bucket.removeReplacement(candidate)
+	bucket.addReplacement(member, rt.k)
+	return true
+}
+
+// Remove removes the contact with `key` from the table. The most recently
+// seen replacement candidate in the same bucket, if any, is promoted to
+// take its place.
+func (rt *RoutingTable) Remove(key node.Key) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	bucket := &rt.buckets[rt.bucketIndex(key)]
+	if i := bucket.indexOf(key); i >= 0 {
+		rt.replaceWithCandidate(bucket, i)
+	} else {
+		bucket.removeReplacement(key)
+	}
+}
+
+// Fail records that the contact with `key` failed to respond to an RPC.
+// A contact that has failed `staleThreshold` times in a row is stale, and
+// is replaced by the most recently seen replacement candidate if there is
+// one. Otherwise the stale contact is only flagged, as the paper suggests,
+// so that a peer which loses its own connectivity does not flush its whole
+// table. Stale contacts are left out of Closest. Fail returns true if the
+// contact was removed.
+func (rt *RoutingTable) Fail(key node.Key) bool {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	bucket := &rt.buckets[rt.bucketIndex(key)]
+	i := bucket.indexOf(key)
+	if i < 0 {
+		bucket.removeReplacement(key)
+		return false
+	}
+	bucket.Contacts[i].Failures++
+	if bucket.Contacts[i].Failures < staleThreshold || len(bucket.Replacements) == 0 {
+		return false
+	}
+	rt.replaceWithCandidate(bucket, i)
+	return true
+}
+
+// Closest returns the `n` contacts in the table that are closest
+// to `target`, sorted by ascending distance. Stale contacts are left out.
+func (rt *RoutingTable) Closest(target node.Key, n int) []node.Contact {
+	rt.mutex.RLock()
+	closest := []node.Contact{}
+	for _, bucket := range rt.buckets {
+		for _, contact := range bucket.Contacts {
+			if !isStale(contact) {
+				closest = append(closest, contact)
+			}
+		}
+	}
+	rt.mutex.RUnlock()
+
+	node.SortByDistance(closest, target)
+	if len(closest) > n {
+		closest = closest[:n]
+	}
+	return closest
+}
+
+// Bucket returns a copy of bucket number `i`.
+func (rt *RoutingTable) Bucket(i int) Bucket {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	return rt.buckets[i].copy()
+}
+
+// Len returns the number of contacts in the table, not
+// counting replacement candidates.
+func (rt *RoutingTable) Len() int {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	n := 0
+	for _, bucket := range rt.buckets {
+		n += len(bucket.Contacts)
+	}
+	return n
+}
+
+// Snapshot returns a copy of all buckets in the table.
+func (rt *RoutingTable) Snapshot() []Bucket {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	buckets := make([]Bucket, len(rt.buckets))
+	for i, bucket := range rt.buckets {
+		buckets[i] = bucket.copy()
+	}
+	return buckets
+}
+
+// NumBuckets returns the number of buckets in the table.
+func (rt *RoutingTable) NumBuckets() int {
+	return len(rt.buckets)
+}
+
+// BucketIndex returns the index of the bucket that `key` belongs in.
+func (rt *RoutingTable) BucketIndex(key node.Key) int {
+	return rt.bucketIndex(key)
+}
+
+// Touch resets the last refresh time for bucket number `i`.
+func (rt *RoutingTable) Touch(i int) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	rt.refreshed[i] = time.Now()
+}
+
+// LastRefresh returns the last refresh time for bucket number `i`.
+func (rt *RoutingTable) LastRefresh(i int) time.Time {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	return rt.refreshed[i]
+}
+
+// RandomKey returns a random key that falls in the range of bucket number `i`.
+func (rt *RoutingTable) RandomKey(i int) node.Key {
+	values := 1<<uint(rt.b) - 1
+	level := node.KeySizeBits/rt.b - 1 - i/values
+	d := node.GenerateRandomKey()
+	for l := 0; l < level; l++ {
+		setDigit(&d, l, rt.b, 0)
+	}
+	setDigit(&d, level, rt.b, i%values+1)
+	return rt.self.Distance(d)
+}
+
+// bucketIndex returns the index of the bucket for the first non-zero digit
+// of the distance to `key`. Buckets are numbered so that the ones for the
+// digits furthest from `self` come last, which for b = 1 makes the index
+// equal to the length of the distance in bits, minus one.
+func (rt *RoutingTable) bucketIndex(key node.Key) int {
+	d := rt.self.Distance(key)
+	level := d.PrefixLength() / rt.b
+	values := 1<<uint(rt.b) - 1
+	v := digit(d, level, rt.b)
+	if v == 0 { // Only for `self`, which shares the bucket of the closest keys.
+		v = 1
+	}
+	return (node.KeySizeBits/rt.b-1-level)*values + v - 1
+}
+
+// digit returns digit number `level` of `key`, read as digits of `b` bits.
+func digit(key node.Key, level, b int) int {
+	v := 0
+	for i := level * b; i < (level+1)*b; i++ {
+		v = v<<1 | int(key[i/8]>>uint(7-i%8)&1)
+	}
+	return v
+}
+
+// setDigit sets digit number `level` of `key`, read as digits of `b` bits, to `v`.
+func setDigit(key *node.Key, level, b, v int) {
+	for i := (level+1)*b - 1; i >= level*b; i-- {
+		mask := byte(0x80) >> uint(i%8)
+		if v&1 != 0 {
+			key[i/8] |= mask
+		} else {
+			key[i/8] &^= mask
+		}
+		v >>= 1
+	}
+}
+
+// replaceWithCandidate removes contact number `i` from `bucket`, and
+// promotes the most recently seen replacement candidate that is within
+// the IP limits, if any, to the tail of the bucket.
+func (rt *RoutingTable) replaceWithCandidate(bucket *Bucket, i int) {
+	bucket.remove(i)
+	for j := len(bucket.Replacements) - 1; j >= 0; j-- {
+		candidate := bucket.Replacements[j]
+		if rt.allowed(candidate, bucket) {
+			bucket.addToTail(candidate)
+			bucket.Replacements = append(bucket.Replacements[:j], bucket.Replacements[j+1:]...)
+			return
+		}
+	}
+}
+
+// allowed reports whether adding `contact` to `bucket` keeps
+// the table within its IP limits.
+func (rt *RoutingTable) allowed(contact node.Contact, bucket *Bucket) bool {
+	limits := rt.limits
+	if limits == (IPLimits{}) {
+		return true
+	}
+	inBucket := countIPs(contact, bucket.Contacts)
+	if exceeds(inBucket.ip, limits.BucketIP) || exceeds(inBucket.subnet, limits.BucketSubnet) {
+		return false
+	}
+	if limits.TableIP == 0 && limits.TableSubnet == 0 {
+		return true
+	}
+	inTable := ipCount{}
+	for i := range rt.buckets {
+		count := countIPs(contact, rt.buckets[i].Contacts)
+		inTable.ip += count.ip
+		inTable.subnet += count.subnet
+	}
+	return !exceeds(inTable.ip, limits.TableIP) && !exceeds(inTable.subnet, limits.TableSubnet)
+}
+
+// RTT returns the smoothed round-trip time of the contact
+// with `key`, or zero if it is unknown.
+func (rt *RoutingTable) RTT(key node.Key) time.Duration {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	bucket := &rt.buckets[rt.bucketIndex(key)]
+	if i := bucket.indexOf(key); i >= 0 {
+		return bucket.Contacts[i].RTT
+	}
+	return 0
+}
+
+// smoothRTT folds `sample` into the smoothed round-trip time `rtt` the same
+// way as TCP does (RFC 6298), with a gain of 1/8. Zero means unknown.
+func smoothRTT(rtt, sample time.Duration) time.Duration {
+	switch {
+	case sample == 0:
+		return rtt
+	case rtt == 0:
+		return sample
+	}
+	return rtt - rtt/8 + sample/8
+}
+
+func isStale(contact node.Contact) bool {
+	return contact.Failures >= staleThreshold
+}
+
+// Bucket operations ---------------------------------------------------------
+
+func (bucket *Bucket) copy() Bucket {
+	return Bucket{
+		Contacts:     append([]node.Contact(nil), bucket.Contacts...),
+		Replacements: append([]node.Contact(nil), bucket.Replacements...),
+	}
+}
+
+func (bucket *Bucket) indexOf(key node.Key) int {
+	for i, c := range bucket.Contacts {
+		if c.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (bucket *Bucket) indexOfReplacement(key node.Key) int {
+	for i, c := range bucket.Replacements {
+		if c.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (bucket *Bucket) remove(i int) {
+	bucket.Contacts = append(bucket.Contacts[:i], bucket.Contacts[i+1:]...)
+}
+
+// slowest returns the index of the contact with the highest round-trip time.
+func (bucket *Bucket) slowest() int {
+	slowest := 0
+	for i, c := range bucket.Contacts {
+		if c.RTT > bucket.Contacts[slowest].RTT {
+			slowest = i
+		}
+	}
+	return slowest
+}
+
+func (bucket *Bucket) addToTail(contact node.Contact) {
+	bucket.Contacts = append(bucket.Contacts, contact)
+}
+
+// addReplacement adds `contact` as the most recently seen replacement
+// candidate, dropping the least recently seen one if there are `max` already.
+func (bucket *Bucket) addReplacement(contact node.Contact, max int) {
+	bucket.removeReplacement(contact.Key)
+	if len(bucket.Replacements) >= max {
+		bucket.Replacements = bucket.Replacements[1:]
+	}
+	bucket.Replacements = append(bucket.Replacements, contact)
+}
+
+func (bucket *Bucket) removeReplacement(key node.Key) {
+	for i, c := range bucket.Replacements {
+		if c.Key == key {
+			bucket.Replacements = append(bucket.Replacements[:i], bucket.Replacements[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package peer
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/askft/kademlia/encoding"
+	"github.com/askft/kademlia/node"
+	"github.com/askft/kademlia/store"
+)
+
+func TestRoutingTableRemovePromotesReplacement(t *testing.T) {
+	rt := NewRoutingTable(node.Key{}, defaultK, 1, IPLimits{})
+
+	for i := 0; i < defaultK; i++ {
+		_, result := rt.Add(node.Contact{Key: testFarKey(byte(i))})
+		assertEqual(t, result, Added)
+	}
+	for i := 0; i < defaultK+2; i++ {
+		head, result := rt.Add(node.Contact{Key: testFarKey(byte(100 + i))})
+		assertEqual(t, result, Full)
+		assertEqual(t, head.Key, testFarKey(0))
+	}
+	bucket := rt.Bucket(rt.BucketIndex(testFarKey(0)))
+	assertEqual(t, len(bucket.Replacements), defaultK)
+	assertEqual(t, bucket.Replacements[0].Key, testFarKey(102))
+
+	rt.Remove(testFarKey(0))
+	bucket = rt.Bucket(rt.BucketIndex(testFarKey(0)))
+	assertEqual(t, len(bucket.Contacts), defaultK)
+	assertEqual(t, bucket.Contacts[defaultK-1].Key, testFarKey(byte(100+defaultK+1)))
+	assertEqual(t, len(bucket.Replacements), defaultK-1)
+	assertEqual(t, rt.Len(), defaultK)
+}
+
+func TestRoutingTableIgnoresSelf(t *testing.T) {
+	self := node.Key(encoding.HashData([]byte("self")))
+	rt := NewRoutingTable(self, defaultK, 1, IPLimits{})
+	rt.Add(node.Contact{Key: self})
+	assertEqual(t, rt.Len(), 0)
+}
+
+func TestConcurrentBootstrap(t *testing.T) {
+	bootstrap, server := newTestPeer(t)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		p, server := newTestPeer(t)
+		defer server.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.Bootstrap(bootstrap.Contact); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assertEqual(t, bootstrap.Table().Len(), 8)
+}
+
+var testPeers = 0
+
+// newTestPeer starts a peer listening on a free local port.
+func newTestPeer(t *testing.T) (*Peer, *Server) {
+	testPeers++
+	p, err := NewPeer(&Options{
+		Key:       encoding.HashData([]byte(strconv.Itoa(testPeers))),
+		Host:      net.ParseIP("127.0.0.1"),
+		Port:      "0",
+		Store:     store.NewMemStore(),
+		NetworkID: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go server.Run(&wg)
+	return p, server
+}
+
+// newSilentContact returns a contact that accepts connections but never
+// answers, until the returned listener is closed.
+func newSilentContact(t *testing.T) (node.Contact, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := listener.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	silent := node.Contact{
+		Key:  encoding.HashData([]byte("silent")),
+		Host: net.ParseIP("127.0.0.1"),
+		Port: port,
+	}
+	return silent, listener
+}
+
+// testKey returns a key that ends with the bytes in `suffix`,
+// and is zero otherwise.
+func testKey(suffix ...byte) node.Key {
+	key := node.Key{}
+	copy(key[len(key)-len(suffix):], suffix)
+	return key
+}
+
+// testFarKey is like testKey, but with the first bit set, so that
+// it falls in the bucket furthest from the zero key.
+func testFarKey(suffix ...byte) node.Key {
+	key := testKey(suffix...)
+	key[0] = 128
+	return key
+}
+
+func TestRoutingTableRandomKey(t *testing.T) {
+	rt := NewRoutingTable(node.Key(encoding.HashData([]byte("self"))), defaultK, 1, IPLimits{})
+	for _, i := range []int{0, 1, 7, 8, 80, 158, 159} {
+		assertEqual(t, rt.BucketIndex(rt.RandomKey(i)), i)
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	rt := NewRoutingTable(node.Key(encoding.HashData([]byte("self"))), defaultK, 1, IPLimits{})
+	contacts := []node.Contact{}
+	for i := 0; i < 500; i++ {
+		contact := node.Contact{Key: encoding.HashData([]byte(strconv.Itoa(i)))}
+		if _, result := rt.Add(contact); result == Added {
+			contacts = append(contacts, contact)
+		}
+	}
+
+	target := node.Key(encoding.HashData([]byte("target")))
+	node.SortByDistance(contacts, target)
+	closest := rt.Closest(target, defaultK)
+	assertEqual(t, len(closest), defaultK)
+	for i := range closest {
+		assertEqual(t, closest[i].Key, contacts[i].Key)
+	}
+}
+
+func TestRoutingTableFail(t *testing.T) {
+	rt := NewRoutingTable(node.Key{}, defaultK, 1, IPLimits{})
+	for i := 0; i < defaultK; i++ {
+		rt.Add(node.Contact{Key: testFarKey(byte(i))})
+	}
+
+	// Without replacement candidates, a stale contact is only flagged.
+	for i := 0; i < staleThreshold; i++ {
+		assertEqual(t, rt.Fail(testFarKey(0)), false)
+	}
+	assertEqual(t, rt.Len(), defaultK)
+	assertEqual(t, len(rt.Closest(testFarKey(0), defaultK)), defaultK-1)
+	assertNotEqual(t, rt.Closest(testFarKey(0), 1)[0].Key, testFarKey(0))
+
+	// Being seen again clears the failures.
+	rt.Add(node.Contact{Key: testFarKey(0)})
+	assertEqual(t, rt.Closest(testFarKey(0), 1)[0].Key, testFarKey(0))
+
+	// With a replacement candidate, a stale contact is swapped out.
+	rt.Add(node.Contact{Key: testFarKey(100)})
+	for i := 0; i < staleThreshold-1; i++ {
+		assertEqual(t, rt.Fail(testFarKey(1)), false)
+	}
+	assertEqual(t, rt.Fail(testFarKey(1)), true)
+	assertEqual(t, rt.Len(), defaultK)
+	assertEqual(t, rt.Closest(testFarKey(100), 1)[0].Key, testFarKey(100))
+}
+
+func TestRoutingTableRTT(t *testing.T) {
+	rt := NewRoutingTable(node.Key{}, defaultK, 1, IPLimits{})
+
+	rt.Add(node.Contact{Key: testFarKey(0), RTT: 80 * time.Millisecond})
+	rt.Add(node.Contact{Key: testFarKey(0)})
+	assertEqual(t, rt.RTT(testFarKey(0)), 80*time.Millisecond)
+	rt.Add(node.Contact{Key: testFarKey(0), RTT: 160 * time.Millisecond})
+	assertEqual(t, rt.RTT(testFarKey(0)), 90*time.Millisecond)
+
+	for i := 1; i < defaultK; i++ {
+		rt.Add(node.Contact{Key: testFarKey(byte(i)), RTT: 10 * time.Millisecond})
+	}
+
+	// A newcomer that is not much faster than the slowest member waits.
+	_, result := rt.Add(node.Contact{Key: testFarKey(100), RTT: 50 * time.Millisecond})
+	assertEqual(t, result, Full)
+
+	// A much faster newcomer may take the place of the slowest member.
+	slow, result := rt.Add(node.Contact{Key: testFarKey(101), RTT: 5 * time.Millisecond})
+	assertEqual(t, result, Slow)
+	assertEqual(t, slow.Key, testFarKey(0))
+	assertEqual(t, rt.RTT(testFarKey(101)), time.Duration(0))
+	assertEqual(t, rt.Demote(testFarKey(0), testFarKey(101)), true)
+	assertEqual(t, rt.RTT(testFarKey(101)), 5*time.Millisecond)
+	assertEqual(t, rt.RTT(testFarKey(0)), time.Duration(0))
+	bucket := rt.Bucket(rt.BucketIndex(testFarKey(0)))
+	assertEqual(t, bucket.Replacements[len(bucket.Replacements)-1].Key, testFarKey(0))
+}
+
+func TestRoutingTableIPLimits(t *testing.T) {
+	rt := NewRoutingTable(node.Key{}, defaultK, 1, IPLimits{BucketIP: 2, BucketSubnet: 3, TableSubnet: 4})
+	contact := func(b byte, ip string) node.Contact {
+		key := node.Key{}
+		key[0] = 128 >> (b % 2)
+		key[19] = b
+		return node.Contact{Key: key, Host: net.ParseIP(ip)}
+	}
+
+	rt.Add(contact(0, "10.0.0.1"))
+	rt.Add(contact(2, "10.0.0.1"))
+	_, result := rt.Add(contact(4, "10.0.0.1")) // Same IP, same bucket.
+	assertEqual(t, result, Limited)
+	rt.Add(contact(6, "10.0.0.2"))
+	rt.Add(contact(8, "10.0.0.3")) // Same subnet, same bucket.
+	rt.Add(contact(10, "10.0.1.1"))
+	assertEqual(t, rt.Len(), 4)
+	assertEqual(t, len(rt.Bucket(rt.BucketIndex(contact(0, "").Key)).Replacements), 2)
+
+	rt.Add(contact(1, "10.0.0.4"))
+	rt.Add(contact(3, "10.0.0.5")) // Same subnet, whole table.
+	assertEqual(t, rt.Len(), 5)
+
+	// Removing a contact makes room in its subnet.
+	rt.Remove(contact(6, "").Key)
+	bucket := rt.Bucket(rt.BucketIndex(contact(0, "").Key))
+	assertEqual(t, len(bucket.Contacts), 4)
+	assertEqual(t, bucket.Contacts[3].Key, contact(8, "").Key)
+
+	// A candidate over the limits is not promoted.
+	rt.Remove(contact(8, "").Key)
+	bucket = rt.Bucket(rt.BucketIndex(contact(0, "").Key))
+	assertEqual(t, len(bucket.Contacts), 3)
+	assertEqual(t, len(bucket.Replacements), 1)
+}
+
+func TestRoutingTableKeepsAddress(t *testing.T) {
+	rt := NewRoutingTable(node.Key{}, defaultK, 1, IPLimits{})
+	key := testFarKey()
+
+	rt.Add(node.Contact{Key: key, Host: net.ParseIP("10.0.0.1"), Port: "4000"})
+	rt.Fail(key)
+	known, result := rt.Add(node.Contact{Key: key, Host: net.ParseIP("10.0.0.2"), Port: "4001"})
+	assertEqual(t, result, Moved)
+	assertEqual(t, known.Address(), "10.0.0.1:4000")
+	bucket := rt.Bucket(rt.BucketIndex(key))
+	assertEqual(t, len(bucket.Contacts), 1)
+	assertEqual(t, bucket.Contacts[0].Address(), "10.0.0.1:4000")
+	assertEqual(t, bucket.Contacts[0].Failures, 1)
+
+	// The new address takes over once the old one is gone.
+	rt.Remove(key)
+	bucket = rt.Bucket(rt.BucketIndex(key))
+	assertEqual(t, len(bucket.Contacts), 1)
+	assertEqual(t, bucket.Contacts[0].Address(), "10.0.0.2:4001")
+	assertEqual(t, len(bucket.Replacements), 0)
+}
+
+func TestRoutingTableDigitBuckets(t *testing.T) {
+	rt := NewRoutingTable(node.Key{}, defaultK, 4, IPLimits{})
+	assertEqual(t, rt.NumBuckets(), 40*15)
+
+	key := node.Key{}
+	key[0] = 0xf0 // First digit 15.
+	assertEqual(t, rt.BucketIndex(key), 39*15+14)
+	key[0] = 0x10 // First digit 1.
+	assertEqual(t, rt.BucketIndex(key), 39*15)
+	key[0] = 0x01 // Second digit 1.
+	assertEqual(t, rt.BucketIndex(key), 38*15)
+	key[0] = 0
+	key[19] = 0x0f // Last digit 15.
+	assertEqual(t, rt.BucketIndex(key), 14)
+
+	self := node.Key(encoding.HashData([]byte("self")))
+	for _, b := range []int{1, 2, 4, 5, 8} {
+		rt := NewRoutingTable(self, defaultK, b, IPLimits{})
+		for _, i := range []int{0, 1, 7, 8, rt.NumBuckets() / 2, rt.NumBuckets() - 1} {
+			assertEqual(t, rt.BucketIndex(rt.RandomKey(i)), i)
+		}
+	}
+}
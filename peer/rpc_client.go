@@ -1,7 +1,12 @@
 package peer
 
 import (
+	"context"
+	"net"
 	"net/rpc"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/askft/kademlia/node"
 )
@@ -9,75 +14,147 @@ import (
 /*
 	RPC client for the Kademlia protocol (PING, STORE, FIND_NODE, FIND_VALUE).
 
+	Every call gives up after the ping or RPC timeout of the peer, or when
+	its context is done, whichever comes first. The connection is then
+	closed, so that no goroutine is left waiting for the response. Failed
+	calls return an *RPCError that says what kind of failure it was, and
+	count as a failure of the contact in the routing table, unless the
+	context of the caller was done first. Successful calls add the contact
+	to the routing table together with the measured round-trip time.
+
+	Requests are signed, and in secure mode a response that is not signed
+	by the contact that sent it is a failure. See rpc_signature.go.
+
 	TODO
 		- Uninitialized MessageResponse array values are `nil`. BE CAREFUL!
 */
 
 // SendPing sends a PING RPC.
-func (peer *Peer) SendPing(contact node.Contact, target node.Key, done chan MessageResponsePing) {
+func (peer *Peer) SendPing(ctx context.Context, contact node.Contact) (*MessageResponsePing, error) {
 	req := &MessageRequestPing{
-		MessageCommon: createCommonWithNonce(peer.Contact),
+		MessageCommon: createCommonWithNonce(peer.Contact, peer.networkID),
 	}
 	res := &MessageResponsePing{}
-	err := peer.call(contact, "RPC.RecvPing", req, res)
+	err := peer.call(ctx, contact, "RPC.RecvPing", req, res, peer.pingTimeout)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	done <- *res
-	peer.UpdateTable(res.Sender)
+	return res, nil
 }
 
-// SendStore sends a STORE RPC.
-// 	TODO send two RPCs - first one to check if it exists already,
-//  and if not then send the data.
-func (peer *Peer) SendStore(contact node.Contact, data []byte, done chan MessageResponseStore) {
-	req := &MessageRequestStore{
-		MessageCommon: createCommonWithNonce(peer.Contact),
-		Data:          data,
-	}
+// SendStore sends a STORE RPC. A non-zero `ttl` asks the
+// contact to keep `data` as a cached copy that expires after `ttl`.
+//
+//	TODO send two RPCs - first one to check if it exists already,
+//	and if not then send the data.
+func (peer *Peer) SendStore(ctx context.Context, contact node.Contact, data []byte, ttl time.Duration) (*MessageResponseStore, error) {
+	return peer.sendStore(ctx, contact, &MessageRequestStore{
+		Data: data,
+		TTL:  ttl,
+	})
+}
+
+// sendStore sends `req` in a STORE RPC, after filling in its common fields.
+func (peer *Peer) sendStore(ctx context.Context, contact node.Contact, req *MessageRequestStore) (*MessageResponseStore, error) {
+	req.MessageCommon = createCommonWithNonce(peer.Contact, peer.networkID)
 	res := &MessageResponseStore{}
-	err := peer.call(contact, "RPC.RecvStore", req, res)
+	err := peer.call(ctx, contact, "RPC.RecvStore", req, res, peer.rpcTimeout)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	done <- *res
-	peer.UpdateTable(res.Sender)
+	return res, nil
 }
 
 // SendFindNode sends a FIND_NODE RPC.
-func (peer *Peer) SendFindNode(contact node.Contact, target node.Key, done chan MessageResponseFindNode) {
+func (peer *Peer) SendFindNode(ctx context.Context, contact node.Contact, target node.Key) (*MessageResponseFindNode, error) {
 	req := &MessageRequestFindNode{
-		MessageCommon: createCommonWithNonce(peer.Contact),
+		MessageCommon: createCommonWithNonce(peer.Contact, peer.networkID),
 		Target:        target,
 	}
 	res := &MessageResponseFindNode{}
-	err := peer.call(contact, "RPC.RecvFindNode", req, res)
+	err := peer.call(ctx, contact, "RPC.RecvFindNode", req, res, peer.rpcTimeout)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	done <- *res
-	peer.UpdateTable(res.Sender)
+	return res, nil
 }
 
 // SendFindValue sends a FIND_VALUE_RPC.
-func (peer *Peer) SendFindValue(contact node.Contact, target node.Key, done chan MessageResponseFindValue) {
+func (peer *Peer) SendFindValue(ctx context.Context, contact node.Contact, target node.Key) (*MessageResponseFindValue, error) {
 	req := &MessageRequestFindValue{
-		MessageCommon: createCommonWithNonce(peer.Contact),
+		MessageCommon: createCommonWithNonce(peer.Contact, peer.networkID),
 		Target:        target,
 	}
 	res := &MessageResponseFindValue{}
-	err := peer.call(contact, "RPC.RecvFindValue", req, res)
+	err := peer.call(ctx, contact, "RPC.RecvFindValue", req, res, peer.rpcTimeout)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	done <- *res
-	peer.UpdateTable(res.Sender)
+	return res, nil
 }
 
-func (peer *Peer) call(contact node.Contact, method string, args, reply interface{}) error {
-	client, err := rpc.Dial("tcp", contact.Address())
+// call invokes `method` at `contact` and checks that the response belongs to
+// the request, giving up after `timeout`. Failures are returned as an
+// *RPCError, except when `ctx` was cancelled, in which case the error of the
+// context is returned. Only failures that happen before `ctx` is done count
+// against the contact, so that a caller with a tight deadline does not make
+// healthy contacts look stale. A contact that answers with an error, such as
+// a refused STORE, is alive, and counts as seen rather than as failed.
+func (peer *Peer) call(ctx context.Context, contact node.Contact, method string, req, res message, timeout time.Duration) error {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	fail := func(err error, dialing bool) error {
+		kind := classify(ctx, err, dialing)
+		switch {
+		case kind == 0:
+			return ctx.Err()
+		case kind == RemoteError:
+			seen := contact
+			seen.RTT = 0
+			peer.UpdateTable(seen)
+		case parent.Err() == nil:
+			peer.table.Fail(contact.Key)
+		}
+		return &RPCError{Kind: kind, Method: method, Contact: contact, Err: err}
+	}
+
+	peer.sign(req)
+	start := time.Now()
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", contact.Address())
 	if err != nil {
-		return err
+		return fail(err, true)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	call := client.Go(method, req, res, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return fail(call.Error, false)
+		}
+	case <-ctx.Done():
+		return fail(ctx.Err(), false)
+	}
+
+	if res.common().Nonce != req.common().Nonce {
+		return fail(errors.New("response nonce does not match request"), false)
+	}
+	if res.common().NetworkID != peer.networkID {
+		return fail(errNetworkMismatch, false)
 	}
-	return client.Call(method, args, reply)
+	if err := peer.verifyMessage(res); err != nil {
+		return fail(err, false)
+	}
+
+	// The responder is known to be at the address that was dialed,
+	// whatever address it claims.
+	sender := res.common().Sender
+	sender.Host, sender.Port = contact.Host, contact.Port
+	sender.RTT = time.Since(start)
+	peer.UpdateTable(sender)
+	return nil
 }
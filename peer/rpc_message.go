@@ -1,28 +1,39 @@
 package peer
 
 import (
+	"time"
+
 	"github.com/askft/kademlia/node"
 )
 
 type MessageCommon struct {
-	Sender node.Contact
-	Nonce  node.Key
+	Sender    node.Contact
+	Nonce     node.Key
+	NetworkID string
+	Signature []byte // Signature by the sender, if it has a key pair. See sign.
 }
 
-func createCommon(sender node.Contact, nonce node.Key) MessageCommon {
-	return MessageCommon{
-		Sender: sender,
-		Nonce:  nonce,
-	}
+// message is implemented by all requests and responses.
+type message interface {
+	common() *MessageCommon
 }
 
-func createCommonWithNonce(sender node.Contact) MessageCommon {
+func (m *MessageCommon) common() *MessageCommon {
+	return m
+}
+
+func createCommon(sender node.Contact, nonce node.Key, networkID string) MessageCommon {
 	return MessageCommon{
-		Sender: sender,
-		Nonce:  node.GenerateRandomKey(),
+		Sender:    sender,
+		Nonce:     nonce,
+		NetworkID: networkID,
 	}
 }
 
+func createCommonWithNonce(sender node.Contact, networkID string) MessageCommon {
+	return createCommon(sender, node.GenerateRandomKey(), networkID)
+}
+
 type MessageRequestPing struct {
 	MessageCommon
 }
@@ -33,7 +44,13 @@ type MessageResponsePing struct {
 
 type MessageRequestStore struct {
 	MessageCommon
-	Data []byte
+	Data      []byte
+	TTL       time.Duration // Non-zero for a cached copy, which expires after TTL.
+	Publisher node.Key      // Original publisher of a replicated value. Zero means the sender.
+	Expires   time.Time     // Expiry of a replicated value. Zero means a full `timeOptions.Expire`.
+	Key       node.Key      // Key of a mutable value. Zero means the hash of Data.
+	Signed    bool          // True if Data is a SignedItem.
+	CAS       int64         // Sequence number that the stored item must have. Zero means any.
 }
 
 type MessageResponseStore struct {
@@ -60,4 +77,5 @@ type MessageResponseFindValue struct {
 	MessageCommon
 	Contacts []node.Contact
 	Data     []byte
+	Signed   bool // True if Data is a SignedItem.
 }
@@ -5,11 +5,14 @@ import (
 	"log"
 	"net"
 	"net/rpc"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/askft/kademlia/encoding"
+	"github.com/askft/kademlia/node"
 )
 
 /*
@@ -20,75 +23,138 @@ import (
 		- FIND_VALUE : like FIND_NODE, but return value if found in node
 */
 
-// RPC is the receiver required by net/rpc.
+// RPC is the receiver required by net/rpc. Every connection is served
+// by its own receiver, which knows the host that the connection is from.
 type RPC struct {
-	peer *Peer
+	peer   *Peer
+	remote net.IP // Host of the connection, or nil if unknown.
 }
 
 // RecvPing signals to the sender that this peer is online.
 func (r *RPC) RecvPing(req *MessageRequestPing, res *MessageResponsePing) error {
 	fmt.Println("RecvPing")
-	r.peer.UpdateTable(req.Sender)
-	res.Sender = r.peer.Contact
-	res.Nonce = req.Nonce
+	if err := r.accept(req, res); err != nil {
+		return err
+	}
+	r.peer.sign(res)
 	return nil
 }
 
-// RecvStore stores a key-value pair at this peer.
+// RecvStore stores a key-value pair at this peer. A replicated
+// value keeps its original publisher and expiry, and no value
+// lives longer than `timeOptions.Expire`, not even a cached one. A mutable value
+// is stored at its key if the validator accepts it, and a signed
+// item if it is correctly signed and not older than the stored one.
 func (r *RPC) RecvStore(req *MessageRequestStore, res *MessageResponseStore) error {
 	fmt.Println("RecvStore")
-	r.peer.UpdateTable(req.Sender)
-	res.Sender = r.peer.Contact
-	res.Nonce = req.Nonce
-	key, err := r.peer.Put(req.Data) // TODO should also store req.Sender
+	if err := r.accept(req, res); err != nil {
+		return err
+	}
+	var (
+		key string
+		err error
+	)
+	publisher := req.Publisher
+	if publisher == (node.Key{}) {
+		publisher = req.Sender.Key
+	}
+	expires := time.Now().Add(timeOptions.Expire)
+	if !req.Expires.IsZero() && req.Expires.Before(expires) {
+		expires = req.Expires
+	}
+	switch {
+	case req.Signed:
+		key = encoding.EncodeHash(req.Key)
+		err = r.peer.putItem(req.Key, req.Data, publisher, expires, req.CAS)
+	case req.Key != (node.Key{}):
+		key = encoding.EncodeHash(req.Key)
+		err = r.peer.putMutable(req.Key, req.Data, publisher, expires)
+	case req.TTL > 0:
+		ttl := req.TTL
+		if ttl > timeOptions.Expire {
+			ttl = timeOptions.Expire
+		}
+		key, err = r.peer.putCached(req.Data, publisher, ttl)
+	default:
+		key, err = r.peer.putRegular(req.Data, publisher, expires)
+	}
 	if err != nil {
 		return err
 	}
 	fmt.Printf("stored data at %s", key)
+	r.peer.sign(res)
 	return nil
 }
 
 // RecvFindNode returns `k` closest nodes to requested key.
 func (r *RPC) RecvFindNode(req *MessageRequestFindNode, res *MessageResponseFindNode) error {
 	fmt.Printf("RecvFindNode from [ %s ].\n", req.Sender.Address())
-	r.peer.UpdateTable(req.Sender)
-	res.Sender = r.peer.Contact
-	res.Nonce = req.Nonce
-	res.Contacts = r.peer.FindClosest(req.Target, k)
+	if err := r.accept(req, res); err != nil {
+		return err
+	}
+	res.Contacts = r.peer.FindClosest(req.Target, r.peer.k)
+	r.peer.sign(res)
 	return nil
 }
 
 // RecvFindValue returns value at key if found, else returns `k` closest nodes to key.
 func (r *RPC) RecvFindValue(req *MessageRequestFindValue, res *MessageResponseFindValue) error {
 	fmt.Println("RecvFindValue")
-	r.peer.UpdateTable(req.Sender)
-	res.Sender = r.peer.Contact
-	res.Nonce = req.Nonce
-	data, err := r.peer.Get(encoding.EncodeHash(req.Target))
-	if err != nil {
-		fmt.Println("data not found")
+	if err := r.accept(req, res); err != nil {
 		return err
 	}
-	if data != nil {
-		res.Data = data
-		return nil
+	record, err := r.peer.Record(encoding.EncodeHash(req.Target))
+	if err == nil && record.Data != nil {
+		res.Data = record.Data
+		res.Signed = record.Signed
+	} else {
+		fmt.Println("data not found")
+		res.Contacts = r.peer.FindClosest(req.Target, r.peer.k)
+	}
+	r.peer.sign(res)
+	return nil
+}
+
+// accept checks that `req` comes from a peer in the same network and adds
+// that peer to the routing table. What the sender says about its own
+// round-trip time and liveness is ignored, and so is its host if the
+// host of the connection is known. In secure mode, the sender is
+// only added if it signed `req`. Pings that adding the sender calls for
+// are left running, so that they don't count towards the round-trip time
+// that the sender measures. It fills in the common part of `res`,
+// which the handler signs once the rest of `res` is filled in.
+func (r *RPC) accept(req, res message) error {
+	if req.common().NetworkID != r.peer.networkID {
+		return errNetworkMismatch
+	}
+	sender := req.common().Sender
+	sender.RTT = 0
+	sender.LastSeen = time.Time{}
+	sender.Failures = 0
+	if r.remote != nil {
+		sender.Host = r.remote
+	}
+	if err := r.peer.verifyMessage(req); err != nil {
+		fmt.Println("accept (not added):", err)
+	} else if check := r.peer.addContact(sender); check != nil {
+		go check()
 	}
-	res.Contacts = r.peer.FindClosest(req.Target, k)
+	*res.common() = createCommon(r.peer.Contact, req.common().Nonce, r.peer.networkID)
 	return nil
 }
 
+// Server serves RPC calls from other peers on behalf of a single peer.
 type Server struct {
 	port     string
 	addr     *net.TCPAddr
 	listener *net.TCPListener
+	peer     *Peer
+	quit     chan struct{}
 }
 
+// NewServer creates a server for `peer`. If the peer's port is "0",
+// a free port is chosen and written back to `peer.Contact.Port`.
 func NewServer(peer *Peer) (*Server, error) {
-	err := rpc.Register(&RPC{peer})
-	if err != nil {
-		return nil, err
-	}
-
 	tcpAddr, err := net.ResolveTCPAddr("tcp", ":"+peer.Contact.Port)
 	if err != nil {
 		return nil, err
@@ -99,10 +165,15 @@ func NewServer(peer *Peer) (*Server, error) {
 		return nil, err
 	}
 
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	peer.Contact.Port = port
+
 	return &Server{
-		peer.Contact.Port,
+		port,
 		tcpAddr,
 		listener,
+		peer,
+		make(chan struct{}),
 	}, nil
 }
 
@@ -115,9 +186,35 @@ func (s *Server) Run(wg *sync.WaitGroup) {
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
 			log.Println(errors.Wrap(err, "failed to connect"))
 			continue
 		}
-		go rpc.ServeConn(conn)
+		go s.serve(conn)
+	}
+}
+
+// serve serves the RPC calls on `conn` until the client hangs up.
+func (s *Server) serve(conn net.Conn) {
+	r := &RPC{peer: s.peer}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		r.remote = addr.IP
 	}
+	server := rpc.NewServer()
+	if err := server.Register(r); err != nil {
+		log.Println(errors.Wrap(err, "failed to serve"))
+		conn.Close()
+		return
+	}
+	server.ServeConn(conn)
+}
+
+// Close stops the server from accepting new connections.
+func (s *Server) Close() error {
+	close(s.quit)
+	return s.listener.Close()
 }
@@ -0,0 +1,129 @@
+package peer
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/askft/kademlia/node"
+)
+
+/*
+	Signed messages, as in S/Kademlia.
+
+	A secure key only shows that a contact's key is derived from a public
+	key, which anyone can copy from a FIND_NODE response. A peer with a
+	key pair therefore signs every request and response it sends, and in
+	secure mode a sender is only added to the routing table if its message
+	is signed with the private key that belongs to its key. The signature
+	covers the nonce, so that a response can't be replayed for another
+	request, and everything in the message that the receiver acts on.
+
+	See https://doi.org/10.1109/ICPADS.2007.4447808
+*/
+
+// sign signs `m` with the peer's private key, if it has one.
+func (peer *Peer) sign(m message) {
+	if peer.privateKey == nil {
+		return
+	}
+	m.common().Signature = ed25519.Sign(peer.privateKey, digest(m))
+}
+
+// verifyMessage returns an error if the peer is in secure mode and the
+// sender of `m` does not have a verified key, or did not sign `m`.
+func (peer *Peer) verifyMessage(m message) error {
+	if !peer.secure {
+		return nil
+	}
+	sender := m.common().Sender
+	if err := peer.verifyKey(sender); err != nil {
+		return err
+	}
+	if !ed25519.Verify(sender.PublicKey, digest(m), m.common().Signature) {
+		return errors.Errorf("message from %s has an invalid signature", sender)
+	}
+	return nil
+}
+
+// digest returns the bytes that the signature of `m` covers.
+func digest(m message) []byte {
+	d := &messageDigest{}
+	d.bytes([]byte(fmt.Sprintf("%T", m)))
+	c := m.common()
+	d.key(c.Nonce)
+	d.bytes([]byte(c.NetworkID))
+	d.contact(c.Sender)
+	switch m := m.(type) {
+	case *MessageRequestStore:
+		d.bytes(m.Data)
+		d.int(int64(m.TTL))
+		d.key(m.Publisher)
+		d.time(m.Expires)
+		d.key(m.Key)
+		d.bool(m.Signed)
+		d.int(m.CAS)
+	case *MessageRequestFindNode:
+		d.key(m.Target)
+	case *MessageRequestFindValue:
+		d.key(m.Target)
+	case *MessageResponseFindNode:
+		d.contacts(m.Contacts)
+	case *MessageResponseFindValue:
+		d.contacts(m.Contacts)
+		d.bytes(m.Data)
+		d.bool(m.Signed)
+	}
+	return d.Bytes()
+}
+
+// messageDigest encodes the fields of a message unambiguously,
+// with every variable-length field prefixed by its length.
+type messageDigest struct {
+	bytes.Buffer
+}
+
+func (d *messageDigest) int(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	d.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (d *messageDigest) bool(v bool) {
+	if v {
+		d.WriteByte(1)
+	} else {
+		d.WriteByte(0)
+	}
+}
+
+func (d *messageDigest) bytes(v []byte) {
+	d.int(int64(len(v)))
+	d.Write(v)
+}
+
+func (d *messageDigest) key(key node.Key) {
+	d.Write(key[:])
+}
+
+func (d *messageDigest) time(t time.Time) {
+	d.int(t.Unix())
+	d.int(int64(t.Nanosecond()))
+}
+
+func (d *messageDigest) contact(contact node.Contact) {
+	d.key(contact.Key)
+	d.bytes([]byte(contact.Address()))
+	d.bytes(contact.PublicKey)
+	d.key(contact.Proof)
+}
+
+func (d *messageDigest) contacts(contacts []node.Contact) {
+	d.int(int64(len(contacts)))
+	for _, contact := range contacts {
+		d.contact(contact)
+	}
+}
@@ -0,0 +1,217 @@
+package peer
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/askft/kademlia/node"
+)
+
+type contactState int
+
+const (
+	unqueried contactState = iota
+	inFlight
+	succeeded
+	failed
+	found   // Answered with the value.
+	skipped // Queried by another path of a disjoint lookup.
+)
+
+type shortlistEntry struct {
+	contact node.Contact
+	state   contactState
+}
+
+// shortlist holds the contacts found during a lookup,
+// sorted by ascending distance to the lookup target.
+type shortlist struct {
+	target  node.Key
+	k       int
+	b       int       // Bits per digit.
+	claims  *claimSet // Shared by the paths of a disjoint lookup.
+	path    int
+	entries []*shortlistEntry
+	seen    map[node.Key]bool
+}
+
+func newShortlist(self, target node.Key, k, b int) *shortlist {
+	return &shortlist{
+		target: target,
+		k:      k,
+		b:      b,
+		seen:   map[node.Key]bool{self: true},
+	}
+}
+
+// add inserts the contacts that have not been seen before.
+func (s *shortlist) add(contacts []node.Contact) {
+	for _, contact := range contacts {
+		if s.seen[contact.Key] {
+			continue
+		}
+		s.seen[contact.Key] = true
+		d := s.target.Distance(contact.Key)
+		i := len(s.entries)
+		for i > 0 && d.Less(s.target.Distance(s.entries[i-1].contact.Key)) {
+			i--
+		}
+		s.entries = append(s.entries, nil)
+		copy(s.entries[i+1:], s.entries[i:])
+		s.entries[i] = &shortlistEntry{contact: contact}
+	}
+}
+
+// closest returns the k closest entries that have not failed,
+// and that are not queried by another path.
+func (s *shortlist) closest() []*shortlistEntry {
+	closest := []*shortlistEntry{}
+	for _, entry := range s.entries {
+		if entry.state == failed || entry.state == skipped {
+			continue
+		}
+		closest = append(closest, entry)
+		if len(closest) == s.k {
+			break
+		}
+	}
+	return closest
+}
+
+// next returns at most `n` of the k closest entries that have not been
+// queried yet, and claims them for the path of `s`. Entries that have been
+// claimed by another path are skipped from then on.
+func (s *shortlist) next(n int) []*shortlistEntry {
+	for {
+		next := s.unqueried(n)
+		claimed := true
+		for _, entry := range next {
+			if !s.claims.claim(entry.contact.Key, s.path) {
+				entry.state = skipped
+				claimed = false
+			}
+		}
+		if claimed {
+			return next
+		}
+	}
+}
+
+// unqueried returns at most `n` of the k closest entries that have not been
+// queried yet. Entries that are equally close, in that their distances to
+// the target start with the same number of zero digits, are ordered by
+// their round-trip time, fastest first and unknown last.
+func (s *shortlist) unqueried(n int) []*shortlistEntry {
+	next := []*shortlistEntry{}
+	for _, entry := range s.closest() {
+		if entry.state == unqueried {
+			next = append(next, entry)
+		}
+	}
+	sort.SliceStable(next, func(i, j int) bool {
+		pi := s.target.Distance(next[i].contact.Key).PrefixLength() / s.b
+		pj := s.target.Distance(next[j].contact.Key).PrefixLength() / s.b
+		if pi != pj {
+			return pi > pj
+		}
+		return faster(next[i].contact.RTT, next[j].contact.RTT)
+	})
+	if len(next) > n {
+		next = next[:n]
+	}
+	return next
+}
+
+// faster reports whether round-trip time `a` is known and lower than `b`.
+func faster(a, b time.Duration) bool {
+	return a > 0 && (b == 0 || a < b)
+}
+
+// best returns the closest contact that has not failed and is not
+// queried by another path, and false if there is no such contact.
+func (s *shortlist) best() (node.Contact, bool) {
+	for _, entry := range s.entries {
+		if entry.state != failed && entry.state != skipped {
+			return entry.contact, true
+		}
+	}
+	return node.Contact{}, false
+}
+
+// results returns the <=k closest contacts that answered.
+func (s *shortlist) results() []node.Contact {
+	results := []node.Contact{}
+	for _, entry := range s.entries {
+		if entry.state != succeeded {
+			continue
+		}
+		results = append(results, entry.contact)
+		if len(results) == s.k {
+			break
+		}
+	}
+	return results
+}
+
+// cacheTarget returns the closest contact that answered without the value,
+// together with the number of contacts known to be closer to the target.
+func (s *shortlist) cacheTarget() (node.Contact, int, bool) {
+	closer := 0
+	for _, entry := range s.entries {
+		switch entry.state {
+		case succeeded:
+			return entry.contact, closer, true
+		case failed, skipped:
+			continue
+		}
+		closer++
+	}
+	return node.Contact{}, 0, false
+}
+
+// mergeShortlists merges the shortlists of the paths of a disjoint lookup.
+// Every contact keeps the state it got on the path that queried it.
+func mergeShortlists(lists []*shortlist) *shortlist {
+	first := lists[0]
+	merged := &shortlist{
+		target: first.target,
+		k:      first.k,
+		b:      first.b,
+		seen:   map[node.Key]bool{},
+	}
+	states := map[node.Key]contactState{}
+	for _, list := range lists {
+		for _, entry := range list.entries {
+			merged.add([]node.Contact{entry.contact})
+			if entry.state != unqueried && entry.state != skipped {
+				states[entry.contact.Key] = entry.state
+			}
+		}
+	}
+	for _, entry := range merged.entries {
+		entry.state = states[entry.contact.Key]
+	}
+	return merged
+}
+
+// claimSet records which path of a disjoint lookup queries which contact.
+type claimSet struct {
+	mutex   sync.Mutex
+	claimed map[node.Key]int
+}
+
+// claim reports whether the contact with `key` may be queried by `path`,
+// in that no other path has claimed it. A nil set allows everything.
+func (c *claimSet) claim(key node.Key, path int) bool {
+	if c == nil {
+		return true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if p, ok := c.claimed[key]; ok {
+		return p == path
+	}
+	c.claimed[key] = path
+	return true
+}
@@ -0,0 +1,203 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/askft/kademlia/encoding"
+	"github.com/askft/kademlia/node"
+	"github.com/askft/kademlia/store"
+)
+
+/*
+	Signed mutable items, as in BEP 44.
+
+	An item is stored at the hash of the public key of its owner and an
+	optional salt, so that one key pair can own many items. Every version
+	carries a sequence number and a signature over the salt, the sequence
+	number and the value. Nodes only accept correctly signed items, and
+	only keep the one with the highest sequence number. A store can also
+	ask for compare-and-swap, in that it only succeeds if the stored item
+	has a given sequence number.
+
+	See http://bittorrent.org/beps/bep_0044.html
+*/
+
+// SignedItem is a mutable value signed by the owner of a key pair.
+type SignedItem struct {
+	PublicKey ed25519.PublicKey `json:"k"`
+	Salt      []byte            `json:"salt,omitempty"`
+	Seq       int64             `json:"seq"`
+	Value     []byte            `json:"v"`
+	Signature []byte            `json:"sig"`
+}
+
+// NewSignedItem creates version `seq` of the item owned
+// by `priv` with `salt`, and signs it.
+func NewSignedItem(priv ed25519.PrivateKey, salt []byte, seq int64, value []byte) *SignedItem {
+	item := &SignedItem{
+		PublicKey: priv.Public().(ed25519.PublicKey),
+		Salt:      salt,
+		Seq:       seq,
+		Value:     value,
+	}
+	item.Signature = ed25519.Sign(priv, item.signed())
+	return item
+}
+
+// ItemKey returns the key that the items owned by `pub` with `salt` are stored at.
+func ItemKey(pub ed25519.PublicKey, salt []byte) node.Key {
+	return encoding.HashData(append(append([]byte{}, pub...), salt...))
+}
+
+// Key returns the key that `item` is stored at.
+func (item *SignedItem) Key() node.Key {
+	return ItemKey(item.PublicKey, item.Salt)
+}
+
+// Verify returns an error unless `item` is correctly signed.
+func (item *SignedItem) Verify() error {
+	if len(item.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("item has no valid public key")
+	}
+	if !ed25519.Verify(item.PublicKey, item.signed(), item.Signature) {
+		return errors.New("item has an invalid signature")
+	}
+	return nil
+}
+
+// signed returns the bytes that the signature of `item` covers,
+// encoded the same way as in BEP 44.
+func (item *SignedItem) signed() []byte {
+	b := bytes.Buffer{}
+	if len(item.Salt) > 0 {
+		b.WriteString("4:salt" + strconv.Itoa(len(item.Salt)) + ":")
+		b.Write(item.Salt)
+	}
+	b.WriteString("3:seqi" + strconv.FormatInt(item.Seq, 10) + "e")
+	b.WriteString("1:v" + strconv.Itoa(len(item.Value)) + ":")
+	b.Write(item.Value)
+	return b.Bytes()
+}
+
+// decodeItem decodes the item in `data` and checks that
+// it is correctly signed and belongs at `key`.
+func decodeItem(key node.Key, data []byte) (*SignedItem, error) {
+	item := &SignedItem{}
+	if err := json.Unmarshal(data, item); err != nil {
+		return nil, errors.Wrap(err, "could not decode item")
+	}
+	if err := item.Verify(); err != nil {
+		return nil, err
+	}
+	if item.Key() != key {
+		return nil, errors.New("item does not belong at key")
+	}
+	return item, nil
+}
+
+// putItem stores the signed item in `data` at `key`, published by
+// `publisher`, that expires at `expires`. It fails if the item is not
+// correctly signed, if its sequence number is lower than that of the
+// stored item, or if `cas` is non-zero and the stored item has another
+// sequence number.
+func (peer *Peer) putItem(key node.Key, data []byte, publisher node.Key, expires time.Time, cas int64) error {
+	item, err := decodeItem(key, data)
+	if err != nil {
+		return err
+	}
+	keyStr := encoding.EncodeHash(key)
+	now := time.Now()
+
+	peer.storing.Lock()
+	defer peer.storing.Unlock()
+
+	if record, err := peer.store.GetRecord(keyStr); err == nil && record.Signed && !record.Expired(now) {
+		stored, err := decodeItem(key, record.Data)
+		if err != nil {
+			return errors.Wrap(err, "stored item is invalid")
+		}
+		switch {
+		case cas != 0 && stored.Seq != cas:
+			return errors.Errorf("compare-and-swap failed: stored sequence number is %d, not %d", stored.Seq, cas)
+		case item.Seq < stored.Seq:
+			return errors.Errorf("sequence number %d is lower than stored %d", item.Seq, stored.Seq)
+		case item.Seq == stored.Seq && !bytes.Equal(item.Value, stored.Value):
+			return errors.Errorf("sequence number %d is already stored with another value", item.Seq)
+		}
+	}
+	_, err = peer.store.PutRecord(store.Record{
+		Key:       keyStr,
+		Data:      data,
+		Publisher: publisher,
+		Received:  now,
+		Expires:   expires,
+		Signed:    true,
+	})
+	return err
+}
+
+// IterativeStoreItem finds the <=k closest nodes to the key of `item` and
+// stores it in each of them. A non-zero `cas` makes a node only store the
+// item if the item it holds has sequence number `cas`.
+func (peer *Peer) IterativeStoreItem(ctx context.Context, item *SignedItem, cas int64, quorum int) (*StoreResult, error) {
+	if err := item.Verify(); err != nil {
+		return &StoreResult{}, err
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return &StoreResult{}, err
+	}
+	key := item.Key()
+	return peer.iterativeStore(ctx, key, store.Record{
+		Key:    encoding.EncodeHash(key),
+		Data:   data,
+		Signed: true,
+	}, quorum, cas)
+}
+
+// IterativeFindItem finds the signed item owned by `pub` with `salt`.
+// Unlike other lookups, it does not stop at the first node that has the
+// item, but asks all of the k closest nodes, and returns the correctly
+// signed item with the highest sequence number. It returns nil if no
+// node has the item, together with the <=k closest nodes to its key.
+func (peer *Peer) IterativeFindItem(ctx context.Context, pub ed25519.PublicKey, salt []byte) (*SignedItem, []node.Contact, error) {
+	key := ItemKey(pub, salt)
+	var (
+		mutex sync.Mutex
+		best  *SignedItem
+	)
+	query := func(ctx context.Context, contact node.Contact) ([]node.Contact, []byte, error) {
+		res, err := peer.SendFindValue(ctx, contact, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(res.Data) == 0 {
+			return res.Contacts, nil, nil
+		}
+		item, err := decodeItem(key, res.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if best == nil || item.Seq > best.Seq {
+			best = item
+		}
+		return nil, nil, nil
+	}
+	_, list, err := peer.lookup(ctx, key, query)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if best != nil {
+		return best, nil, nil
+	}
+	return nil, list.results(), errors.Wrap(err, "find item lookup stopped")
+}
@@ -1,17 +1,154 @@
 package peer
 
 import (
-// "time"
+	"context"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
-// func (peer *Peer) TickerRefresh() {
-// 	ticker := time.NewTicker(timeOptions.Refresh * time.Second)
-// 	for {
-// 		select {
-// 		case <-ticker.C:
-// 			for _, bucket := range peer.routingTable {
-
-// 			}
-// 		}
-// 	}
-// }
+// Start launches the peer's background maintenance jobs.
+// They run until Stop is called.
+func (peer *Peer) Start() {
+	peer.jobs.Add(4)
+	go peer.tickerRefresh()
+	go peer.tickerSweep()
+	go peer.tickerReplicate()
+	go peer.tickerRepublish()
+	if peer.tableFile != "" {
+		peer.jobs.Add(1)
+		go peer.tickerSave()
+	}
+}
+
+// Stop stops the jobs launched by Start and waits for them to return.
+// The routing table is saved one last time if saving is enabled.
+func (peer *Peer) Stop() {
+	close(peer.quit)
+	peer.jobs.Wait()
+	if peer.tableFile != "" {
+		if err := peer.SaveTable(peer.tableFile); err != nil {
+			log.Println(errors.Wrap(err, "failed to save routing table"))
+		}
+	}
+}
+
+// tickerRefresh periodically refreshes every bucket in which no
+// lookup has been performed within `timeOptions.Refresh`.
+func (peer *Peer) tickerRefresh() {
+	defer peer.jobs.Done()
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-peer.quit:
+			return
+		case <-ticker.C:
+			peer.refreshStaleBuckets()
+		}
+	}
+}
+
+// refreshStaleBuckets performs a node lookup for a random key in the range
+// of each stale bucket. The lookup itself marks the bucket as refreshed.
+func (peer *Peer) refreshStaleBuckets() {
+	if peer.table.Len() == 0 {
+		return
+	}
+	ctx, cancel := peer.jobContext()
+	defer cancel()
+	for q := 0; q < peer.table.NumBuckets(); q++ {
+		if time.Since(peer.table.LastRefresh(q)) < timeOptions.Refresh {
+			continue
+		}
+		if _, err := peer.IterativeFindNodeContext(ctx, peer.table.RandomKey(q)); err != nil {
+			return
+		}
+	}
+}
+
+// jobContext returns a context that is cancelled when the peer is stopped.
+func (peer *Peer) jobContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-peer.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// tickerSweep periodically deletes expired records from the store.
+func (peer *Peer) tickerSweep() {
+	defer peer.jobs.Done()
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-peer.quit:
+			return
+		case <-ticker.C:
+			if err := peer.sweep(); err != nil {
+				log.Println(errors.Wrap(err, "failed to delete expired records"))
+			}
+		}
+	}
+}
+
+// tickerReplicate periodically replicates the records in the store.
+func (peer *Peer) tickerReplicate() {
+	defer peer.jobs.Done()
+	ticker := time.NewTicker(timeOptions.Replicate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-peer.quit:
+			return
+		case <-ticker.C:
+			ctx, cancel := peer.jobContext()
+			if err := peer.replicate(ctx); err != nil {
+				log.Println(errors.Wrap(err, "failed to replicate records"))
+			}
+			cancel()
+		}
+	}
+}
+
+// tickerRepublish periodically republishes the records published by the peer.
+func (peer *Peer) tickerRepublish() {
+	defer peer.jobs.Done()
+	ticker := time.NewTicker(timeOptions.Republish)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-peer.quit:
+			return
+		case <-ticker.C:
+			ctx, cancel := peer.jobContext()
+			if err := peer.republish(ctx); err != nil {
+				log.Println(errors.Wrap(err, "failed to republish records"))
+			}
+			cancel()
+		}
+	}
+}
+
+// tickerSave periodically saves the routing table to `peer.tableFile`.
+func (peer *Peer) tickerSave() {
+	defer peer.jobs.Done()
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-peer.quit:
+			return
+		case <-ticker.C:
+			if err := peer.SaveTable(peer.tableFile); err != nil {
+				log.Println(errors.Wrap(err, "failed to save routing table"))
+			}
+		}
+	}
+}
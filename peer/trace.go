@@ -0,0 +1,131 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/askft/kademlia/node"
+)
+
+// LookupTrace records what happened during an iterative lookup. Attach one
+// to a context with WithLookupTrace, and the lookups given that context
+// will fill it in.
+type LookupTrace struct {
+	mutex    sync.Mutex
+	Target   node.Key
+	Start    time.Time
+	Duration time.Duration // Total duration of the lookup.
+	Hops     int           // Number of rounds of RPCs that were sent, on the longest path.
+	Paths    int           // Number of disjoint paths.
+	Queries  []QueryTrace  // The RPCs in the order they completed.
+	Err      error         // Why the lookup stopped early, if it did.
+}
+
+// QueryTrace records a single RPC sent during a lookup.
+type QueryTrace struct {
+	Contact  node.Contact
+	Path     int           // Path on which the RPC was sent, starting at 1.
+	Hop      int           // Round in which the RPC was sent, starting at 1.
+	Latency  time.Duration // Time until the response or error.
+	Contacts []node.Contact
+	Value    bool // True if the contact returned the value.
+	Timeout  bool
+	Err      error
+}
+
+type traceKey struct{}
+
+// WithLookupTrace returns a copy of `ctx` that makes lookups record into `trace`.
+func WithLookupTrace(ctx context.Context, trace *LookupTrace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// lookupTraceFrom returns the trace attached to `ctx`, or nil if there is none.
+// Recording into a nil trace does nothing.
+func lookupTraceFrom(ctx context.Context) *LookupTrace {
+	trace, _ := ctx.Value(traceKey{}).(*LookupTrace)
+	return trace
+}
+
+func (trace *LookupTrace) start(target node.Key, paths int) {
+	if trace == nil {
+		return
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	trace.Target = target
+	trace.Paths = paths
+	trace.Start = time.Now()
+}
+
+func (trace *LookupTrace) finish(err error) {
+	if trace == nil {
+		return
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	trace.Duration = time.Since(trace.Start)
+	trace.Err = err
+}
+
+func (trace *LookupTrace) hop(hop int) {
+	if trace == nil {
+		return
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	if hop > trace.Hops {
+		trace.Hops = hop
+	}
+}
+
+func (trace *LookupTrace) query(q QueryTrace) {
+	if trace == nil {
+		return
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	q.Timeout = IsTimeout(q.Err)
+	trace.Queries = append(trace.Queries, q)
+}
+
+// Timeouts returns the number of RPCs that timed out.
+func (trace *LookupTrace) Timeouts() int {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	n := 0
+	for _, q := range trace.Queries {
+		if q.Timeout {
+			n++
+		}
+	}
+	return n
+}
+
+// String formats `trace` as a human readable report, one line per RPC.
+func (trace *LookupTrace) String() string {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "lookup [ %s ]: %d paths, %d hops, %d queries, %s\n",
+		trace.Target, trace.Paths, trace.Hops, len(trace.Queries), trace.Duration)
+	for _, q := range trace.Queries {
+		result := fmt.Sprintf("%d contacts", len(q.Contacts))
+		switch {
+		case q.Value:
+			result = "value"
+		case q.Timeout:
+			result = "timeout"
+		case q.Err != nil:
+			result = "error: " + q.Err.Error()
+		}
+		fmt.Fprintf(&b, " - path %d, hop %d: %s -> %s (%s)\n", q.Path, q.Hop, q.Contact, result, q.Latency)
+	}
+	if trace.Err != nil {
+		fmt.Fprintf(&b, "stopped: %s\n", trace.Err)
+	}
+	return b.String()
+}
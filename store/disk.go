@@ -0,0 +1,228 @@
+package store
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/askft/kademlia/encoding"
+)
+
+/*
+	DiskStore keeps every record in a file of its own, named by the hex
+	encoding of its key. For keys that encode a SHA-1 hash, which is what
+	the DHT uses, that is the hex encoding of the hash. Other keys, which
+	PutKey also accepts, are hex encoded as they are, after a `k`. A record is written to a temporary file that is
+	synced to disk and then renamed over the old file, so that a crash
+	leaves either the old record or the new one, never a torn write.
+	Temporary files left behind by a crash are removed when the store is
+	opened.
+*/
+
+const (
+	tmpSuffix = ".tmp"
+	keyPrefix = "k" // Prefix of the file names of keys that are not hashes.
+)
+
+// DiskStore is a durable store for DHT data, in a directory on disk.
+type DiskStore struct {
+	mutex sync.Mutex
+	dir   string
+}
+
+// diskRecord is the on-disk representation of a record.
+type diskRecord struct {
+	Key       string    `json:"key,omitempty"`
+	Data      []byte    `json:"data"`
+	Publisher string    `json:"publisher"`
+	Received  time.Time `json:"received"`
+	Expires   time.Time `json:"expires"`
+	Cached    bool      `json:"cached"`
+	Signed    bool      `json:"signed,omitempty"`
+}
+
+// NewDiskStore opens the store in `dir`, creating the directory if needed.
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+tmpSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			return nil, errors.Wrap(err, "could not remove incomplete write")
+		}
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+// Put stores `data` on disk and returns its key.
+func (s *DiskStore) Put(data []byte) (string, error) {
+	return s.PutRecord(Record{Data: data, Received: time.Now()})
+}
+
+// PutKey stores `value` at `key` on disk.
+func (s *DiskStore) PutKey(key string, value []byte) error {
+	_, err := s.PutRecord(Record{Key: key, Data: value, Received: time.Now()})
+	return err
+}
+
+// PutRecord stores `record` on disk and returns its key.
+// It returns once the record has been synced to disk.
+func (s *DiskStore) PutRecord(record Record) (string, error) {
+	key := record.Key
+	if key == "" {
+		key = encoding.EncodeData(record.Data)
+	}
+	path := s.path(key)
+	data, err := json.Marshal(diskRecord{
+		Key:       record.Key,
+		Data:      record.Data,
+		Publisher: encoding.EncodeHash(record.Publisher),
+		Received:  record.Received,
+		Expires:   record.Expires,
+		Cached:    record.Cached,
+		Signed:    record.Signed,
+	})
+	if err != nil {
+		return key, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tmp, err := ioutil.TempFile(s.dir, filepath.Base(path)+".*"+tmpSuffix)
+	if err != nil {
+		return key, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return key, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return key, err
+	}
+	if err := tmp.Close(); err != nil {
+		return key, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return key, err
+	}
+	return key, s.syncDir()
+}
+
+// Get returns the data at `key` if it exists, where
+// `key` is a base64-encoded SHA-1 hash of some data.
+func (s *DiskStore) Get(key string) ([]byte, error) {
+	record, err := s.GetRecord(key)
+	return record.Data, err
+}
+
+// GetRecord returns the record at `key` if it exists.
+func (s *DiskStore) GetRecord(key string) (Record, error) {
+	path := s.path(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Record{}, errors.New("invalid key")
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	saved := diskRecord{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return Record{}, errors.Wrapf(err, "could not parse %s", path)
+	}
+	publisher, err := encoding.DecodeKeyStr(saved.Publisher)
+	if err != nil {
+		return Record{}, errors.Wrapf(err, "invalid publisher in %s", path)
+	}
+	return Record{
+		Key:       saved.Key,
+		Data:      saved.Data,
+		Publisher: publisher,
+		Received:  saved.Received,
+		Expires:   saved.Expires,
+		Cached:    saved.Cached,
+		Signed:    saved.Signed,
+	}, nil
+}
+
+// Delete removes the data at `key` if it exists, where
+// `key` is a base64-encoded SHA-1 hash of some data.
+func (s *DiskStore) Delete(key string) error {
+	path := s.path(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.syncDir()
+}
+
+// Keys returns the keys of all data in the store.
+func (s *DiskStore) Keys() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasSuffix(name, tmpSuffix) {
+			continue
+		}
+		if strings.HasPrefix(name, keyPrefix) {
+			if key, err := hex.DecodeString(name[len(keyPrefix):]); err == nil {
+				keys = append(keys, string(key))
+			}
+			continue
+		}
+		hash, err := hex.DecodeString(name)
+		if err != nil || len(hash) != encoding.Size {
+			continue
+		}
+		var h [encoding.Size]byte
+		copy(h[:], hash)
+		keys = append(keys, encoding.EncodeHash(h))
+	}
+	return keys, nil
+}
+
+// path returns the path of the file for `key`.
+func (s *DiskStore) path(key string) string {
+	if hash, err := encoding.DecodeKeyStr(key); err == nil && encoding.EncodeHash(hash) == key {
+		return filepath.Join(s.dir, hex.EncodeToString(hash[:]))
+	}
+	return filepath.Join(s.dir, keyPrefix+hex.EncodeToString([]byte(key)))
+}
+
+// syncDir syncs the directory of the store, so that
+// renames and removals in it survive a crash.
+func (s *DiskStore) syncDir() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -3,6 +3,7 @@ package store
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/askft/kademlia/encoding"
 )
@@ -10,30 +11,52 @@ import (
 // MemStore is an in-memory (volatile) store for DHT data.
 type MemStore struct {
 	sync.Mutex
-	m map[string][]byte
+	m map[string]Record
 }
 
 // NewMemStore creates and returns a new MemStore handle.
 func NewMemStore() *MemStore {
-	return &MemStore{m: make(map[string][]byte)}
+	return &MemStore{m: make(map[string]Record)}
 }
 
 // Put stores `data` in volatile memory and returns its key.
 func (s *MemStore) Put(data []byte) (string, error) {
+	return s.PutRecord(Record{Data: data, Received: time.Now()})
+}
+
+// PutKey stores `value` at `key` in volatile memory.
+func (s *MemStore) PutKey(key string, value []byte) error {
+	_, err := s.PutRecord(Record{Key: key, Data: value, Received: time.Now()})
+	return err
+}
+
+// PutRecord stores `record` in volatile memory and returns its key.
+func (s *MemStore) PutRecord(record Record) (string, error) {
 	s.Lock()
 	defer s.Unlock()
-	key := encoding.EncodeData(data)
-	s.m[key] = data[:]
+	key := record.Key
+	if key == "" {
+		key = encoding.EncodeData(record.Data)
+	}
+	s.m[key] = record
 	return key, nil
 }
 
 // Get returns the data at `key` if it exists, where
 // `key` is a base64-encoded SHA-1 hash of some data.
 func (s *MemStore) Get(key string) ([]byte, error) {
-	if data, ok := s.m[key]; ok {
-		return data[:], nil
+	record, err := s.GetRecord(key)
+	return record.Data, err
+}
+
+// GetRecord returns the record at `key` if it exists.
+func (s *MemStore) GetRecord(key string) (Record, error) {
+	s.Lock()
+	defer s.Unlock()
+	if record, ok := s.m[key]; ok {
+		return record, nil
 	}
-	return nil, errors.New("invalid key")
+	return Record{}, errors.New("invalid key")
 }
 
 // Delete removes the data at `key` if it exists, where
@@ -44,3 +67,14 @@ func (s *MemStore) Delete(key string) error {
 	delete(s.m, key)
 	return nil
 }
+
+// Keys returns the keys of all data in the store.
+func (s *MemStore) Keys() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	keys := make([]string, 0, len(s.m))
+	for key := range s.m {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
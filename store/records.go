@@ -0,0 +1,88 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/askft/kademlia/encoding"
+)
+
+// WithRecords returns `s` as a RecordStore. If `s` does not implement
+// RecordStore itself, the metadata is kept in memory next to it, and
+// Keys only returns the keys of values stored through the adapter.
+func WithRecords(s Store) RecordStore {
+	if rs, ok := s.(RecordStore); ok {
+		return rs
+	}
+	return &recordAdapter{Store: s, meta: make(map[string]Record)}
+}
+
+// recordAdapter adds metadata to a Store that only keeps raw values.
+type recordAdapter struct {
+	Store
+	mutex sync.Mutex
+	meta  map[string]Record // Records without their data.
+}
+
+func (a *recordAdapter) Put(data []byte) (string, error) {
+	return a.PutRecord(Record{Data: data, Received: time.Now()})
+}
+
+func (a *recordAdapter) PutKey(key string, value []byte) error {
+	_, err := a.PutRecord(Record{Key: key, Data: value, Received: time.Now()})
+	return err
+}
+
+func (a *recordAdapter) PutRecord(record Record) (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var (
+		key = record.Key
+		err error
+	)
+	if key != "" {
+		err = a.Store.PutKey(key, record.Data)
+	} else {
+		key, err = a.Store.Put(record.Data)
+	}
+	if err != nil {
+		return key, err
+	}
+	record.Data = nil
+	a.meta[key] = record
+	return key, nil
+}
+
+// GetRecord returns the value at `key` with its metadata. A value that was
+// not stored through the adapter is returned as a record that never expires.
+func (a *recordAdapter) GetRecord(key string) (Record, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	data, err := a.Store.Get(key)
+	if err != nil {
+		return Record{}, err
+	}
+	record, ok := a.meta[key]
+	if !ok && key != encoding.EncodeData(data) {
+		record.Key = key
+	}
+	record.Data = data
+	return record, nil
+}
+
+func (a *recordAdapter) Delete(key string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.meta, key)
+	return a.Store.Delete(key)
+}
+
+func (a *recordAdapter) Keys() ([]string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	keys := make([]string, 0, len(a.meta))
+	for key := range a.meta {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
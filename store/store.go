@@ -1,8 +1,42 @@
 package store
 
+import (
+	"time"
+
+	"github.com/askft/kademlia/node"
+)
+
 // Store is the interface for a peer's DHT data storage mechanism.
+// Put stores immutable data at the hash of the data, while PutKey stores
+// a mutable value at a key of the caller's choosing.
 type Store interface {
 	Put(data []byte) (string, error)
+	PutKey(key string, value []byte) error
 	Get(key string) ([]byte, error)
 	Delete(key string) error
 }
+
+// RecordStore is a Store that also keeps the metadata of the values in it.
+// Backends that only implement Store can be given one with WithRecords.
+type RecordStore interface {
+	Store
+	PutRecord(record Record) (string, error)
+	GetRecord(key string) (Record, error)
+	Keys() ([]string, error)
+}
+
+// Record is a value together with its metadata.
+type Record struct {
+	Key       string // Key of a mutable value. Empty means the hash of Data.
+	Data      []byte
+	Publisher node.Key  // Node that originally published the value.
+	Received  time.Time // When this copy of the value was stored.
+	Expires   time.Time // When this copy expires. Zero means never.
+	Cached    bool      // True if this copy was cached along a lookup path.
+	Signed    bool      // True if Data is a signed mutable item.
+}
+
+// Expired reports whether `record` has expired at time `now`.
+func (record Record) Expired(now time.Time) bool {
+	return !record.Expires.IsZero() && !now.Before(record.Expires)
+}
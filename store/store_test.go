@@ -0,0 +1,155 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/askft/kademlia/encoding"
+)
+
+// plainStore is a backend that does not keep metadata.
+type plainStore struct {
+	Store
+}
+
+func TestWithRecords(t *testing.T) {
+	mem := NewMemStore()
+	if WithRecords(mem) != RecordStore(mem) {
+		t.Errorf("Expected a RecordStore to be used as it is.")
+	}
+
+	s := WithRecords(plainStore{NewMemStore()})
+	expires := time.Now().Add(time.Hour)
+	key, err := s.PutRecord(Record{Data: []byte("data"), Expires: expires, Cached: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := s.GetRecord(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(record.Data) != "data" || !record.Expires.Equal(expires) || !record.Cached {
+		t.Errorf("Expected the stored record, got %+v.", record)
+	}
+	if keys, _ := s.Keys(); len(keys) != 1 || keys[0] != key {
+		t.Errorf("Expected keys [%s], got %v.", key, keys)
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetRecord(key); err == nil {
+		t.Errorf("Expected the record to be deleted.")
+	}
+	if keys, _ := s.Keys(); len(keys) != 0 {
+		t.Errorf("Expected no keys, got %v.", keys)
+	}
+}
+
+func TestRecordExpired(t *testing.T) {
+	now := time.Now()
+	if (Record{}).Expired(now) {
+		t.Errorf("Expected a record without expiry to never expire.")
+	}
+	if (Record{Expires: now.Add(time.Second)}).Expired(now) {
+		t.Errorf("Expected a record to live until it expires.")
+	}
+	if !(Record{Expires: now}).Expired(now) {
+		t.Errorf("Expected a record to expire at its expiry.")
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour).Round(time.Second)
+	key, err := s.PutRecord(Record{Data: []byte("data"), Expires: expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put([]byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write that was cut short by a crash.
+	if err := ioutil.WriteFile(filepath.Join(dir, "torn"+tmpSuffix), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := s.GetRecord(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(record.Data) != "data" || !record.Expires.Equal(expires) || record.Cached {
+		t.Errorf("Expected the stored record, got %+v.", record)
+	}
+	if keys, _ := s.Keys(); len(keys) != 2 {
+		t.Errorf("Expected 2 keys, got %v.", keys)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "torn"+tmpSuffix)); !os.IsNotExist(err) {
+		t.Errorf("Expected the incomplete write to be removed.")
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(key); err == nil {
+		t.Errorf("Expected the record to be deleted.")
+	}
+	if _, err := s.Get("not a key"); err == nil {
+		t.Errorf("Expected an invalid key to be rejected.")
+	}
+}
+
+func TestPutKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk, err := NewDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{encoding.EncodeData([]byte("name")), "../any/name"}
+	for _, key := range keys {
+		for _, s := range []RecordStore{NewMemStore(), disk, WithRecords(plainStore{NewMemStore()})} {
+			for _, value := range []string{"first", "second"} {
+				if err := s.PutKey(key, []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			record, err := s.GetRecord(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if record.Key != key || string(record.Data) != "second" {
+				t.Errorf("Expected %s at %s, got %+v.", "second", key, record)
+			}
+		}
+	}
+	stored, _ := disk.Keys()
+	sort.Strings(keys)
+	sort.Strings(stored)
+	if strings.Join(stored, " ") != strings.Join(keys, " ") {
+		t.Errorf("Expected keys %v, got %v.", keys, stored)
+	}
+}
@@ -17,6 +17,7 @@ const (
 	ActionGet       = Action("get")
 	ActionBootstrap = Action("bootstrap")
 	ActionTable     = Action("table")
+	ActionTrace     = Action("trace")
 )
 
 func (m Message) Parse() (Action, string, error) {
@@ -30,9 +31,11 @@ func (m Message) Parse() (Action, string, error) {
 
 const uiUsage = `
   usage:
-    store [string]  (store a value and returns its key)
-    get   [key]     (get a value by its key)
-    bootstrap       (connect to the network via the bootstrap node)
+    store [string]    (store a value and returns its key)
+    get   [key]       (get a value by its key)
+    trace [key]       (get a value by its key and show how the lookup went)
+    table [json|dot]  (print the routing table, or export it as JSON or Graphviz DOT)
+    bootstrap         (connect to the network via the bootstrap node)
 `
 
 // UI is a user interface that sends user input to the input channel.
@@ -68,6 +71,6 @@ func (ui *CommandLineUI) Run(wg *sync.WaitGroup) {
 }
 
 func printUsageAndExit() {
-	fmt.Printf("usage: %s [port]\nport must be in range [4000, 5000]\n", os.Args[0])
+	fmt.Printf("usage: %s [-store mem|disk] [-secure] [port]\nport must be in range [4000, 5000]\n", os.Args[0])
 	os.Exit(0)
 }